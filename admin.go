@@ -0,0 +1,241 @@
+package minproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+// Config keys which can't be changed without restarting the proxy.
+var readOnlyCfgKeys = map[string]bool{"id": true, "ip": true, "port": true, "prof_port": true}
+
+// Config keys which only an admin may set, see isAdmin.
+var authCfgKeys = map[string]bool{"requirepass": true, "users": true}
+
+// Shown by CONFIG GET instead of a password.
+const redacted = "******"
+
+// PROXY INFO|BUCKETS|POOLS|CONFIG GET pattern|CONFIG SET key val|RELOAD|
+// MIGRATE bucket addr|MIGRATIONS
+func (s *Server) handleProxy(t *Task) {
+	args, err := GetVals(t.Raw[2:])
+	if err != nil {
+		t.PackErrorReply(err.Error())
+		return
+	}
+	if len(args) == 0 {
+		t.PackErrorReply(ErrBadArgsNum.Error())
+		return
+	}
+
+	switch sub := strings.ToLower(string(args[0])); {
+	case sub == "info" && len(args) == 1:
+		t.PackLocalReply(PackBulk([]byte(s.info())))
+	case sub == "buckets" && len(args) == 1:
+		t.PackLocalReply(packLines(s.bucketLines()))
+	case sub == "pools" && len(args) == 1:
+		var lines []string
+		for _, st := range s.connPool.Stats() {
+			lines = append(lines, fmt.Sprintf("%s size:%d free_slots:%d down:%v breaker:%s", st.Addr, st.Size, st.Free, st.Down, st.Breaker))
+		}
+		for _, st := range s.blockPool.Stats() {
+			lines = append(lines, fmt.Sprintf("%s blocking size:%d free_slots:%d down:%v", st.Addr, st.Size, st.Free, st.Down))
+		}
+		t.PackLocalReply(packLines(lines))
+	case sub == "config" && len(args) == 3 && strings.ToLower(string(args[1])) == "get":
+		t.PackLocalReply(s.configGet(string(args[2])))
+	case sub == "config" && len(args) == 4 && strings.ToLower(string(args[1])) == "set":
+		if authCfgKeys[string(args[2])] && !s.isAdmin(t) {
+			t.PackErrorReply("ERR config key " + string(args[2]) + " can only be set by the default user authenticated with requirepass")
+			return
+		}
+		if err = s.configSet(string(args[2]), args[3]); err != nil {
+			t.PackErrorReply("ERR " + err.Error())
+			return
+		}
+		t.PackLocalReply(PackStatus("OK"))
+	case sub == "migrate" && len(args) == 3:
+		bucket, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			t.PackErrorReply("ERR bad bucket")
+			return
+		}
+		m, err := s.MigrateBucket(bucket, string(args[2]))
+		if err != nil {
+			t.PackErrorReply("ERR " + err.Error())
+			return
+		}
+		t.PackLocalReply(PackBulk([]byte(m.String())))
+	case sub == "migrations" && len(args) == 1:
+		var lines []string
+		for _, m := range s.Migrations() {
+			lines = append(lines, m.String())
+		}
+		t.PackLocalReply(packLines(lines))
+	case sub == "reload" && len(args) == 1:
+		if err = s.Reload(); err != nil {
+			t.PackErrorReply("ERR " + err.Error())
+			return
+		}
+		t.PackLocalReply(PackStatus("OK"))
+	default:
+		t.PackErrorReply("ERR unknown subcommand or wrong number of arguments for '" + sub + "'")
+	}
+}
+
+func packLines(lines []string) []byte {
+	elems := make([][]byte, len(lines))
+	for i, line := range lines {
+		elems[i] = PackBulk([]byte(line))
+	}
+
+	return PackArray(elems)
+}
+
+// Returns the addr clients connect to, "unix:/path" for a unix socket.
+func (s *Server) addr() string {
+	if strings.HasPrefix(s.port, util.UnixPrefix) {
+		return s.port
+	}
+
+	return s.ip + ":" + s.port
+}
+
+func (s *Server) info() string {
+	s.bucketMux.RLock()
+	router := s.router
+	migrations := len(s.migrations)
+	s.bucketMux.RUnlock()
+
+	lines := []string{
+		"# Proxy",
+		"id:" + strconv.Itoa(s.id),
+		"addr:" + s.addr(),
+		"uptime_in_seconds:" + strconv.FormatInt(int64(time.Since(s.startTime)/time.Second), 10),
+		"connected_clients:" + strconv.FormatInt(atomic.LoadInt64(&s.clients), 10),
+		"total_commands_processed:" + strconv.FormatInt(atomic.LoadInt64(&s.cmds), 10),
+		"router:" + router.Name(),
+		"backends:" + strconv.Itoa(len(router.Addrs())),
+		"migrations:" + strconv.Itoa(migrations),
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func (s *Server) bucketLines() (lines []string) {
+	s.bucketMux.RLock()
+	defer s.bucketMux.RUnlock()
+
+	switch r := s.router.(type) {
+	case *BucketRouter:
+		buckets := make([]int, 0, len(r.bucketAddrMap))
+		for b := range r.bucketAddrMap {
+			buckets = append(buckets, b)
+		}
+		sort.Ints(buckets)
+		for _, b := range buckets {
+			line := strconv.Itoa(b) + " " + r.bucketAddrMap[b]
+			if m, ok := s.migrations[b]; ok && m.State() == MigrateRunning {
+				line += " migrating:" + m.To
+			}
+			lines = append(lines, line)
+		}
+	case *SlotRouter:
+		for _, sr := range r.Ranges() {
+			lines = append(lines, strconv.Itoa(sr.Start)+"-"+strconv.Itoa(sr.End)+" "+sr.Addr)
+		}
+	case *KetamaRouter:
+		for _, addr := range r.Addrs() {
+			lines = append(lines, addr+" weight:"+strconv.Itoa(r.weights[addr]))
+		}
+	}
+
+	return
+}
+
+// Returns the config keys matching pattern and their values, non string
+// values are JSON encoded. Passwords are redacted.
+func (s *Server) configGet(pattern string) []byte {
+	s.bucketMux.RLock()
+	cfg := s.cfg
+	s.bucketMux.RUnlock()
+
+	var elems [][]byte
+	for _, key := range cfg.Keys() {
+		if ok, _ := path.Match(pattern, key); !ok {
+			continue
+		}
+		val := redact(key, cfg.GetInterface(key))
+		str, ok := val.(string)
+		if !ok {
+			buf, _ := json.Marshal(val)
+			str = string(buf)
+		}
+		elems = append(elems, PackBulk([]byte(key)), PackBulk([]byte(str)))
+	}
+
+	return PackArray(elems)
+}
+
+// Returns a copy of the cfg value of key with the requirepass, the passwords
+// of the users and any "password" field inside it replaced.
+func redact(key string, val interface{}) interface{} {
+	switch v := val.(type) {
+	case string:
+		if key == "requirepass" || key == "password" {
+			return redacted
+		}
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if key == "users" {
+				m[k] = redact("password", e)
+			} else {
+				m[k] = redact(k, e)
+			}
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = redact(key, e)
+		}
+		return a
+	}
+
+	return val
+}
+
+// Sets the config key on a copy of the running config and applies it. Keys
+// holding a string keep a string, anything else is decoded as JSON.
+func (s *Server) configSet(key string, val []byte) error {
+	if readOnlyCfgKeys[key] {
+		return fmt.Errorf("config key %s is read only", key)
+	}
+
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+
+	s.bucketMux.RLock()
+	cfg := s.cfg.Clone()
+	s.bucketMux.RUnlock()
+
+	var v interface{}
+	if _, ok := cfg.GetInterface(key).(string); ok || json.Unmarshal(val, &v) != nil {
+		v = string(val)
+	}
+	cfg.Set(key, v)
+	conf, err := s.CheckConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	return s.applyConfig(cfg, conf)
+}
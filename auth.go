@@ -0,0 +1,118 @@
+package minproxy
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+const DefaultUser = "default"
+
+var (
+	ErrNoAuth       = errors.New("NOAUTH Authentication required.")
+	ErrHelloNoAuth  = errors.New("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	ErrWrongPass    = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	ErrAuthNoPass   = errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	ErrBadUsersList = errors.New("bad users list err")
+)
+
+// Auth is who cfg lets clients authenticate as:
+//"requirepass":"secret" is the password of the default user,
+//"users":{"alice":"secret"} adds the users AUTH alice secret logs in as.
+// Without either clients needn't authenticate.
+type Auth struct {
+	users map[string]string //user -> password
+}
+
+func NewAuth(cfg *util.Config) (a *Auth, err error) {
+	a = &Auth{users: make(map[string]string)}
+	if pass := cfg.GetString("requirepass"); pass != "" {
+		a.users[DefaultUser] = pass
+	}
+	users, ok := cfg.GetInterface("users").(map[string]interface{})
+	if !ok && cfg.GetInterface("users") != nil {
+		return nil, ErrBadUsersList
+	}
+	for user, v := range users {
+		pass, ok := v.(string)
+		if !ok || user == "" || pass == "" {
+			return nil, ErrBadUsersList
+		}
+		a.users[user] = pass
+	}
+
+	return
+}
+
+func (a *Auth) Required() bool {
+	return a != nil && len(a.users) > 0
+}
+
+// Returns whether password is the one of user. While no password is
+// required the default user logs in with any.
+func (a *Auth) Check(user, password string) bool {
+	if !a.Required() {
+		return user == DefaultUser
+	}
+	pass, ok := a.users[user]
+
+	return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+}
+
+func (s *Server) clientAuth() *Auth {
+	s.bucketMux.RLock()
+	defer s.bucketMux.RUnlock()
+
+	return s.auth
+}
+
+// Returns whether the client may run the command, one which hasn't
+// authenticated yet may only run AUTH and HELLO.
+func (s *Server) authed(t *Task) bool {
+	if t.sess.authed || !s.clientAuth().Required() {
+		return true
+	}
+
+	return t.cmd != nil && (t.cmd.Name == "auth" || t.cmd.Name == "hello")
+}
+
+// Returns whether the client may change who can authenticate: only the
+// default user once it has logged in with requirepass.
+func (s *Server) isAdmin(t *Task) bool {
+	a := s.clientAuth()
+	if a == nil {
+		return false
+	}
+	_, ok := a.users[DefaultUser]
+
+	return ok && t.sess.authed && t.sess.user == DefaultUser
+}
+
+// AUTH [username] password
+func (s *Server) handleAuth(t *Task) {
+	args, err := GetVals(t.Raw[2:])
+	if err != nil {
+		t.PackErrorReply(err.Error())
+		return
+	}
+	if len(args) > 2 {
+		t.PackErrorReply("ERR syntax error")
+		return
+	}
+
+	a := s.clientAuth()
+	user, pass := DefaultUser, string(args[0])
+	if len(args) == 2 {
+		user, pass = string(args[0]), string(args[1])
+	} else if !a.Required() {
+		t.PackErrorReply(ErrAuthNoPass.Error())
+		return
+	}
+	if !a.Check(user, pass) {
+		t.PackErrorReply(ErrWrongPass.Error())
+		return
+	}
+	t.sess.user, t.sess.authed = user, true
+	t.PackLocalReply(PackStatus("OK"))
+}
@@ -0,0 +1,243 @@
+package minproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A proxy SCAN cursor holds the index of the backend in its low ScanIdxBits
+// bits and the cursor of that backend in the others.
+const (
+	ScanIdxBits = 10
+	ScanIdxMask = 1<<ScanIdxBits - 1
+)
+
+var ErrBadCursor = errors.New("ERR invalid cursor")
+
+// Routes the task to every backend, one UnitPkg per backend. SCAN only goes
+// to the backend its cursor is at.
+func (s *Server) broadcastAddrs(t *Task) (addrs []string, err error) {
+	s.bucketMux.RLock()
+	addrs = s.router.Addrs()
+	s.bucketMux.RUnlock()
+	t.nodes = len(addrs)
+
+	if t.cmd.Merge == MergeScan {
+		return t.scanAddr(addrs)
+	}
+	data := Append(t.Raw)
+	t.OutInfos = make([]*UnitPkg, len(addrs))
+	for i := range addrs {
+		t.OutInfos[i] = &UnitPkg{uId: i, data: data}
+	}
+
+	return
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (t *Task) scanAddr(addrs []string) ([]string, error) {
+	val, err := GetVal(t.arg(1))
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := strconv.ParseUint(string(val), 10, 64)
+	if err != nil || int(cursor&ScanIdxMask) >= len(addrs) {
+		return nil, ErrBadCursor
+	}
+
+	idx := int(cursor & ScanIdxMask)
+	raws := append([][]byte{}, t.Raw...)
+	raws[2] = PackBulk([]byte(strconv.FormatUint(cursor>>ScanIdxBits, 10)))
+	t.OutInfos = []*UnitPkg{{uId: idx, data: Append(raws)}}
+
+	return []string{addrs[idx]}, nil
+}
+
+// Turns the cursor a backend replied into a proxy cursor, a finished backend
+// moves the cursor to the next one.
+func (t *Task) mergeScan() error {
+	info := t.OutInfos[0]
+	elems, err := info.subReply()
+	if err != nil {
+		return err
+	}
+	if len(elems) != 2 {
+		return ErrBadReply
+	}
+	val, err := GetVal(elems[0])
+	if err != nil {
+		return ErrBadReply
+	}
+	cursor, err := strconv.ParseUint(string(val), 10, 64)
+	if err != nil || cursor>>(64-ScanIdxBits) != 0 {
+		return ErrBadReply
+	}
+
+	next := cursor<<ScanIdxBits | uint64(info.uId)
+	if cursor == 0 {
+		next = 0
+		if info.uId+1 < t.nodes {
+			next = uint64(info.uId + 1)
+		}
+	}
+	resp := PackArray([][]byte{PackBulk([]byte(strconv.FormatUint(next, 10))), elems[1]})
+	t.Resp = &resp
+
+	return nil
+}
+
+// Concatenates the arrays replied by every backend, the first error is
+// replied instead.
+func (t *Task) mergeConcat() error {
+	var elems [][]byte
+	for _, info := range t.OutInfos {
+		subElems, err := info.subReply()
+		if err != nil {
+			return err
+		}
+		elems = append(elems, subElems...)
+	}
+	resp := PackArray(elems)
+	t.Resp = &resp
+
+	return nil
+}
+
+// Replies the INFO of the first backend with its keyspace section replaced by
+// the keyspaces of all backends summed up.
+func (t *Task) mergeInfo() error {
+	var first *Resp
+	ks := newKeyspace()
+	for _, info := range t.OutInfos {
+		if info.err != nil {
+			return info.err
+		}
+		resp, err := ReadResp(bufio.NewReader(bytes.NewReader(info.data)))
+		if err != nil {
+			return ErrBadReply
+		}
+		if resp.IsError() {
+			t.Resp = &info.data
+			return nil
+		}
+		text := resp.Val
+		if resp.Type == '=' && len(text) >= 4 { //"txt:..."
+			text = text[4:]
+		}
+		if first == nil {
+			first = &Resp{Type: resp.Type, Val: text}
+		}
+		ks.add(string(text))
+	}
+	if first == nil {
+		return ErrBadReply
+	}
+
+	text := removeSection(string(first.Val), "keyspace") + ks.String()
+	if first.Type == '=' {
+		text = "txt:" + text
+	}
+	first.Val = []byte(text)
+	resp := first.Encode(t.Proto)
+	t.Resp = &resp
+
+	return nil
+}
+
+// Returns the INFO text without the section named name.
+func removeSection(text, name string) string {
+	var lines []string
+	skip := false
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			skip = strings.EqualFold(strings.TrimSpace(line[2:]), name)
+		}
+		if !skip && line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "")
+}
+
+// keyspace sums the "db0:keys=1,expires=0,avg_ttl=0" lines of INFO replies,
+// avg_ttl is weighted by expires.
+type keyspace struct {
+	dbs    map[string]map[string]int64
+	fields map[string][]string //field order of every db
+}
+
+func newKeyspace() *keyspace {
+	return &keyspace{dbs: make(map[string]map[string]int64), fields: make(map[string][]string)}
+}
+
+func (ks *keyspace) add(text string) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "db") || !strings.Contains(line, ":") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		db, vals := line[:i], make(map[string]int64)
+		var fields []string
+		for _, kv := range strings.Split(line[i+1:], ",") {
+			j := strings.Index(kv, "=")
+			if j < 0 {
+				continue
+			}
+			n, err := strconv.ParseInt(kv[j+1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			fields, vals[kv[:j]] = append(fields, kv[:j]), n
+		}
+
+		sum, ok := ks.dbs[db]
+		if !ok {
+			sum = make(map[string]int64)
+			ks.dbs[db], ks.fields[db] = sum, fields
+		}
+		for _, f := range fields {
+			if f == "avg_ttl" {
+				sum[f] += vals[f] * vals["expires"]
+				continue
+			}
+			sum[f] += vals[f]
+		}
+	}
+}
+
+func (ks *keyspace) String() string {
+	if len(ks.dbs) == 0 {
+		return ""
+	}
+	dbs := make([]string, 0, len(ks.dbs))
+	for db := range ks.dbs {
+		dbs = append(dbs, db)
+	}
+	sort.Slice(dbs, func(i, j int) bool {
+		a, _ := strconv.Atoi(dbs[i][2:])
+		b, _ := strconv.Atoi(dbs[j][2:])
+		return a < b
+	})
+
+	str := "# Keyspace\r\n"
+	for _, db := range dbs {
+		sum := ks.dbs[db]
+		kvs := make([]string, 0, len(ks.fields[db]))
+		for _, f := range ks.fields[db] {
+			n := sum[f]
+			if f == "avg_ttl" && sum["expires"] > 0 {
+				n /= sum["expires"]
+			}
+			kvs = append(kvs, f+"="+strconv.FormatInt(n, 10))
+		}
+		str += db + ":" + strings.Join(kvs, ",") + "\r\n"
+	}
+
+	return str
+}
@@ -0,0 +1,121 @@
+package minproxy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	ErrClusterDisabledStr = "ERR This instance has cluster support disabled"
+	ClusterBusPortOffset  = 10000
+)
+
+// Answers CLUSTER KEYSLOT/SLOTS/NODES from the router, so cluster aware
+// clients can introspect the topology.
+func (s *Server) handleCluster(t *Task) {
+	if len(t.Raw) < 3 {
+		t.PackErrorReply(ErrBadArgsNum.Error())
+		return
+	}
+	sub, err := GetVal(t.Raw[2])
+	if err != nil {
+		t.PackErrorReply(err.Error())
+		return
+	}
+
+	switch strings.ToLower(string(sub)) {
+	case "keyslot":
+		if len(t.Raw) != 4 {
+			t.PackErrorReply(ErrBadArgsNum.Error())
+			return
+		}
+		key, err := GetVal(t.Raw[3])
+		if err == nil {
+			key, err = GetHashTag(key)
+		}
+		if err != nil {
+			t.PackErrorReply(err.Error())
+			return
+		}
+		t.PackLocalReply(PackInt(int64(Slot(key))))
+	case "slots":
+		ranges, ok := s.slotRanges()
+		if !ok {
+			t.PackErrorReply(ErrClusterDisabledStr)
+			return
+		}
+		elems := make([][]byte, 0, len(ranges))
+		for _, sr := range ranges {
+			host, port := splitAddr(sr.Addr)
+			node := PackArray([][]byte{PackBulk([]byte(host)), PackInt(int64(port)), PackBulk([]byte(nodeId(sr.Addr)))})
+			elems = append(elems, PackArray([][]byte{PackInt(int64(sr.Start)), PackInt(int64(sr.End)), node}))
+		}
+		t.PackLocalReply(PackArray(elems))
+	case "nodes":
+		ranges, ok := s.slotRanges()
+		if !ok {
+			t.PackErrorReply(ErrClusterDisabledStr)
+			return
+		}
+		t.PackLocalReply(PackBulk([]byte(clusterNodes(ranges))))
+	default:
+		t.PackErrorReply("ERR unknown subcommand '" + string(sub) + "'")
+	}
+}
+
+func (s *Server) slotRanges() ([]SlotRange, bool) {
+	s.bucketMux.RLock()
+	defer s.bucketMux.RUnlock()
+
+	r, ok := s.router.(*SlotRouter)
+	if !ok {
+		return nil, false
+	}
+
+	return r.Ranges(), true
+}
+
+//<id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> <slot> ...
+func clusterNodes(ranges []SlotRange) string {
+	var addrs []string
+	nodeSlots := make(map[string][]string)
+	for _, sr := range ranges {
+		if _, ok := nodeSlots[sr.Addr]; !ok {
+			addrs = append(addrs, sr.Addr)
+		}
+		slot := strconv.Itoa(sr.Start)
+		if sr.End != sr.Start {
+			slot += "-" + strconv.Itoa(sr.End)
+		}
+		nodeSlots[sr.Addr] = append(nodeSlots[sr.Addr], slot)
+	}
+
+	lines := make([]string, 0, len(addrs))
+	for i, addr := range addrs {
+		host, port := splitAddr(addr)
+		line := []string{nodeId(addr), host + ":" + strconv.Itoa(port) + "@" + strconv.Itoa(port+ClusterBusPortOffset),
+			"master", "-", "0", "0", strconv.Itoa(i + 1), "connected"}
+		lines = append(lines, strings.Join(append(line, nodeSlots[addr]...), " "))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Backends are not cluster nodes, so the node id is derived from the addr.
+func nodeId(addr string) string {
+	digest := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(digest[:])
+}
+
+func splitAddr(addr string) (host string, port int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ = strconv.Atoi(portStr)
+
+	return
+}
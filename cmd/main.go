@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/zimulala/minproxy"
 	"github.com/zimulala/minproxy/util"
 )
 
 var (
-	cfgPath = flag.String("cfg", "/tmp/cfg.json", "configure path")
+	cfgPath         = flag.String("cfg", "/tmp/cfg.json", "configure path")
+	shutdownTimeout = flag.Duration("shutdown_timeout", 30*time.Second, "max time to drain in-flight requests")
 )
 
 func main() {
@@ -26,12 +32,44 @@ func main() {
 		return
 	}
 
+	s := minproxy.NewServer()
+	go reloadOnSighup(s)
 	go func() {
 		log.Fatalln("failed to listen and serve, err:", http.ListenAndServe(":"+pprof, nil))
 	}()
 
-	s := minproxy.NewServer()
-	if err := s.Start(cfg); err != nil {
+	doneCh := make(chan struct{})
+	go shutdownOnSignal(s, doneCh)
+	if err := s.Start(cfg); err != minproxy.ErrServerClosed {
 		log.Println("failed to start server, err:", err)
+		return
+	}
+	<-doneCh
+}
+
+func shutdownOnSignal(s *minproxy.Server, doneCh chan struct{}) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+	log.Println("got signal:", sig, ", shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Println("failed to drain in-flight requests, err:", err)
+	}
+	close(doneCh)
+}
+
+//kill -HUP <pid>
+func reloadOnSighup(s *minproxy.Server) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if err := s.Reload(); err != nil {
+			log.Println("failed to reload cfg, err:", err)
+			continue
+		}
+		log.Println("cfg reloaded")
 	}
 }
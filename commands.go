@@ -0,0 +1,380 @@
+package minproxy
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+const (
+	CmdWrite     = 1 << iota //may modify the keyspace
+	CmdReadOnly              //never modifies the keyspace
+	CmdBlocking              //may block the conn until a timeout
+	CmdNoSupport             //replied with ErrNoSupport, never sent to a backend
+	CmdBroadcast             //sent to every backend, a write one only when "broadcast_cmds" has it
+)
+
+var (
+	ErrNoSupport   = errors.New("ERR command not supported by proxy")
+	ErrBadCmdsList = errors.New("bad cmds list err")
+)
+
+// Command describes how a command is routed, validated and how its replies
+// are merged. Positions count the command name as 0, a negative LastKey counts
+// from the end (-1 is the last arg), FirstKey 0 means the command has no key.
+// The keys of XREAD, XREADGROUP and of the commands taking numkeys are found
+// by Task.keyRange, keys outside of the range by Task.extraKeys. A command not
+// in the table is refused since its keys can't be found.
+type Command struct {
+	Name     string
+	Arity    int //args including the name, -N means at least N
+	FirstKey int
+	LastKey  int
+	Step     int //args per key, the key and its value for mset
+	Flags    int
+	Merge    int //MergeNone for a single key command
+}
+
+func (c *Command) IsMulti() bool {
+	return c.Merge != MergeNone
+}
+
+func (c *Command) Is(flag int) bool {
+	return c.Flags&flag != 0
+}
+
+func (c *Command) checkArity(n int) bool {
+	if c.Arity >= 0 {
+		return n == c.Arity
+	}
+
+	return n >= -c.Arity
+}
+
+// Returns the positions of the first and the last key of a command of n args.
+func (c *Command) keyRange(n int) (first, last int) {
+	first, last = c.FirstKey, c.LastKey
+	if last < 0 {
+		last += n
+	}
+
+	return
+}
+
+var cmdTable = []*Command{
+	//connection, answered by the proxy
+	{"ping", -1, 0, 0, 0, CmdReadOnly, MergeNone},
+	{"echo", 2, 0, 0, 0, CmdReadOnly, MergeNone},
+	{"hello", -1, 0, 0, 0, CmdReadOnly, MergeNone},
+	{"auth", -2, 0, 0, 0, CmdReadOnly, MergeNone},
+	{"cluster", -2, 0, 0, 0, CmdReadOnly, MergeNone},
+	{"proxy", -2, 0, 0, 0, CmdReadOnly, MergeNone},
+
+	//keys
+	{"del", -2, 1, -1, 1, CmdWrite, MergeSum},
+	{"unlink", -2, 1, -1, 1, CmdWrite, MergeSum},
+	{"exists", -2, 1, -1, 1, CmdReadOnly, MergeSum},
+	{"touch", -2, 1, -1, 1, CmdReadOnly, MergeSum},
+	{"type", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"expire", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"pexpire", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"expireat", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"pexpireat", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"expiretime", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"pexpiretime", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"persist", 2, 1, 1, 1, CmdWrite, MergeNone},
+	{"ttl", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"pttl", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"dump", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"restore", -4, 1, 1, 1, CmdWrite, MergeNone},
+	{"object", -2, 2, 2, 1, CmdReadOnly, MergeNone},
+	{"sort", -2, 1, 1, 1, CmdWrite, MergeNone},
+	{"sort_ro", -2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"rename", 3, 1, 2, 1, CmdWrite, MergeSame},
+	{"renamenx", 3, 1, 2, 1, CmdWrite, MergeSame},
+	{"copy", -3, 1, 2, 1, CmdWrite, MergeSame},
+
+	//strings
+	{"get", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"set", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"setnx", 3, 1, 1, 1, CmdWrite, MergeNone},
+	{"setex", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"psetex", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"getset", 3, 1, 1, 1, CmdWrite, MergeNone},
+	{"getdel", 2, 1, 1, 1, CmdWrite, MergeNone},
+	{"getex", -2, 1, 1, 1, CmdWrite, MergeNone},
+	{"getrange", 4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"setrange", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"substr", 4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"strlen", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"append", 3, 1, 1, 1, CmdWrite, MergeNone},
+	{"incr", 2, 1, 1, 1, CmdWrite, MergeNone},
+	{"decr", 2, 1, 1, 1, CmdWrite, MergeNone},
+	{"incrby", 3, 1, 1, 1, CmdWrite, MergeNone},
+	{"decrby", 3, 1, 1, 1, CmdWrite, MergeNone},
+	{"incrbyfloat", 3, 1, 1, 1, CmdWrite, MergeNone},
+	{"mget", -2, 1, -1, 1, CmdReadOnly, MergeArray},
+	{"mset", -3, 1, -1, 2, CmdWrite, MergeOk},
+	{"msetnx", -3, 1, -1, 2, CmdWrite, MergeSame},
+	{"lcs", -3, 1, 2, 1, CmdReadOnly, MergeSame},
+	{"getbit", 3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"setbit", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"bitcount", -2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"bitpos", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"bitfield", -2, 1, 1, 1, CmdWrite, MergeNone},
+	{"bitfield_ro", -2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"bitop", -4, 2, -1, 1, CmdWrite, MergeSame},
+	{"pfadd", -2, 1, 1, 1, CmdWrite, MergeNone},
+	{"pfcount", -2, 1, -1, 1, CmdReadOnly, MergeSame},
+	{"pfmerge", -2, 1, -1, 1, CmdWrite, MergeSame},
+
+	//hashes
+	{"hget", 3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"hset", -4, 1, 1, 1, CmdWrite, MergeNone},
+	{"hsetnx", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"hmget", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"hmset", -4, 1, 1, 1, CmdWrite, MergeNone},
+	{"hdel", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"hlen", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"hstrlen", 3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"hexists", 3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"hincrby", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"hincrbyfloat", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"hkeys", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"hvals", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"hgetall", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"hrandfield", -2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"hscan", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+
+	//lists
+	{"lpush", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"rpush", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"lpushx", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"rpushx", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"linsert", 5, 1, 1, 1, CmdWrite, MergeNone},
+	{"lpop", -2, 1, 1, 1, CmdWrite, MergeNone},
+	{"rpop", -2, 1, 1, 1, CmdWrite, MergeNone},
+	{"llen", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"lindex", 3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"lset", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"lrange", 4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"ltrim", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"lrem", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"lpos", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"rpoplpush", 3, 1, 2, 1, CmdWrite, MergeSame},
+	{"lmove", 5, 1, 2, 1, CmdWrite, MergeSame},
+	{"blpop", -3, 1, -2, 1, CmdWrite | CmdBlocking, MergeSame},
+	{"brpop", -3, 1, -2, 1, CmdWrite | CmdBlocking, MergeSame},
+	{"brpoplpush", 4, 1, 2, 1, CmdWrite | CmdBlocking, MergeSame},
+	{"blmove", 6, 1, 2, 1, CmdWrite | CmdBlocking, MergeSame},
+	{"lmpop", -4, 2, -1, 1, CmdWrite, MergeSame},
+	{"blmpop", -5, 3, -1, 1, CmdWrite | CmdBlocking, MergeSame},
+
+	//sets
+	{"sadd", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"srem", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"spop", -2, 1, 1, 1, CmdWrite, MergeNone},
+	{"srandmember", -2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"scard", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"sismember", 3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"smismember", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"smembers", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"sscan", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"smove", 4, 1, 2, 1, CmdWrite, MergeSame},
+	{"sinter", -2, 1, -1, 1, CmdReadOnly, MergeSame},
+	{"sunion", -2, 1, -1, 1, CmdReadOnly, MergeSame},
+	{"sdiff", -2, 1, -1, 1, CmdReadOnly, MergeSame},
+	{"sinterstore", -3, 1, -1, 1, CmdWrite, MergeSame},
+	{"sunionstore", -3, 1, -1, 1, CmdWrite, MergeSame},
+	{"sdiffstore", -3, 1, -1, 1, CmdWrite, MergeSame},
+	{"sintercard", -3, 2, -1, 1, CmdReadOnly, MergeSame},
+
+	//sorted sets
+	{"zadd", -4, 1, 1, 1, CmdWrite, MergeNone},
+	{"zincrby", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"zrem", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"zcard", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zcount", 4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zlexcount", 4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zscore", 3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zmscore", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zrank", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zrevrank", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zrange", -4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zrevrange", -4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zrangebyscore", -4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zrevrangebyscore", -4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zrangebylex", -4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zrevrangebylex", -4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zremrangebyrank", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"zremrangebyscore", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"zremrangebylex", 4, 1, 1, 1, CmdWrite, MergeNone},
+	{"zpopmin", -2, 1, 1, 1, CmdWrite, MergeNone},
+	{"zpopmax", -2, 1, 1, 1, CmdWrite, MergeNone},
+	{"zrandmember", -2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"zscan", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"bzpopmin", -3, 1, -2, 1, CmdWrite | CmdBlocking, MergeSame},
+	{"bzpopmax", -3, 1, -2, 1, CmdWrite | CmdBlocking, MergeSame},
+	{"zrangestore", -5, 1, 2, 1, CmdWrite, MergeSame},
+	{"zunion", -3, 2, -1, 1, CmdReadOnly, MergeSame},
+	{"zinter", -3, 2, -1, 1, CmdReadOnly, MergeSame},
+	{"zdiff", -3, 2, -1, 1, CmdReadOnly, MergeSame},
+	{"zintercard", -3, 2, -1, 1, CmdReadOnly, MergeSame},
+	{"zunionstore", -4, 3, -1, 1, CmdWrite, MergeSame},
+	{"zinterstore", -4, 3, -1, 1, CmdWrite, MergeSame},
+	{"zdiffstore", -4, 3, -1, 1, CmdWrite, MergeSame},
+	{"zmpop", -4, 2, -1, 1, CmdWrite, MergeSame},
+	{"bzmpop", -5, 3, -1, 1, CmdWrite | CmdBlocking, MergeSame},
+
+	//geo and streams
+	{"geoadd", -5, 1, 1, 1, CmdWrite, MergeNone},
+	{"geodist", -4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"geohash", -2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"geopos", -2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"geosearch", -7, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"geosearchstore", -8, 1, 2, 1, CmdWrite, MergeSame},
+	{"georadius", -6, 1, 1, 1, CmdWrite, MergeSame},
+	{"georadiusbymember", -5, 1, 1, 1, CmdWrite, MergeSame},
+	{"georadius_ro", -6, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"georadiusbymember_ro", -5, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"xadd", -5, 1, 1, 1, CmdWrite, MergeNone},
+	{"xlen", 2, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"xrange", -4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"xrevrange", -4, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"xdel", -3, 1, 1, 1, CmdWrite, MergeNone},
+	{"xtrim", -4, 1, 1, 1, CmdWrite, MergeNone},
+	{"xack", -4, 1, 1, 1, CmdWrite, MergeNone},
+	{"xpending", -3, 1, 1, 1, CmdReadOnly, MergeNone},
+	{"xclaim", -6, 1, 1, 1, CmdWrite, MergeNone},
+	{"xautoclaim", -6, 1, 1, 1, CmdWrite, MergeNone},
+	{"xread", -4, 1, -1, 1, CmdReadOnly | CmdBlocking, MergeSame},
+	{"xreadgroup", -7, 1, -1, 1, CmdWrite | CmdBlocking, MergeSame},
+	{"xgroup", -2, 2, 2, 1, CmdWrite, MergeNone},
+	{"xinfo", -2, 2, 2, 1, CmdReadOnly, MergeNone},
+
+	//pub/sub, channels are routed like keys, subscribing is answered by the proxy
+	{"publish", 3, 1, 1, 1, 0, MergeNone}, //never read from a replica, subscribers are on the master
+	{"subscribe", -2, 0, 0, 0, CmdReadOnly, MergeNone},
+	{"psubscribe", -2, 0, 0, 0, CmdReadOnly, MergeNone},
+	{"unsubscribe", -1, 0, 0, 0, CmdReadOnly, MergeNone},
+	{"punsubscribe", -1, 0, 0, 0, CmdReadOnly, MergeNone},
+
+	//transactions, all keys must live on one backend
+	{"multi", 1, 0, 0, 0, CmdReadOnly, MergeNone},
+	{"exec", 1, 0, 0, 0, CmdWrite, MergeNone},
+	{"discard", 1, 0, 0, 0, CmdReadOnly, MergeNone},
+	{"watch", -2, 1, -1, 1, CmdReadOnly, MergeSame},
+	{"unwatch", 1, 0, 0, 0, CmdReadOnly, MergeNone},
+
+	//scripting, the keys follow numkeys, scripts and functions are loaded on all backends
+	{"eval", -3, 3, -1, 1, CmdWrite, MergeSame},
+	{"evalsha", -3, 3, -1, 1, CmdWrite, MergeSame},
+	{"eval_ro", -3, 3, -1, 1, CmdReadOnly, MergeSame},
+	{"evalsha_ro", -3, 3, -1, 1, CmdReadOnly, MergeSame},
+	{"fcall", -3, 3, -1, 1, CmdWrite, MergeSame},
+	{"fcall_ro", -3, 3, -1, 1, CmdReadOnly, MergeSame},
+	{"script", -2, 0, 0, 0, CmdReadOnly | CmdBroadcast, MergeFirst},
+	{"function", -2, 0, 0, 0, CmdReadOnly | CmdBroadcast, MergeFirst},
+
+	//keyspace wide and server commands
+	{"keys", 2, 0, 0, 0, CmdReadOnly | CmdBroadcast, MergeConcat},
+	{"scan", -2, 0, 0, 0, CmdReadOnly | CmdBroadcast, MergeScan},
+	{"randomkey", 1, 0, 0, 0, CmdReadOnly | CmdNoSupport, MergeNone},
+	{"dbsize", 1, 0, 0, 0, CmdReadOnly | CmdBroadcast, MergeSum},
+	{"flushdb", -1, 0, 0, 0, CmdWrite | CmdBroadcast, MergeOk},
+	{"flushall", -1, 0, 0, 0, CmdWrite | CmdBroadcast, MergeOk},
+	{"info", -1, 0, 0, 0, CmdReadOnly | CmdBroadcast, MergeInfo},
+	{"select", 2, 0, 0, 0, CmdReadOnly | CmdNoSupport, MergeNone},
+	{"swapdb", 3, 0, 0, 0, CmdWrite | CmdNoSupport, MergeNone},
+	{"move", 3, 1, 1, 1, CmdWrite | CmdNoSupport, MergeNone},
+	{"migrate", -6, 0, 0, 0, CmdWrite | CmdNoSupport, MergeNone},
+	{"wait", 3, 0, 0, 0, CmdReadOnly | CmdNoSupport, MergeNone},
+	{"client", -2, 0, 0, 0, CmdReadOnly | CmdNoSupport, MergeNone},
+	{"config", -2, 0, 0, 0, CmdWrite | CmdNoSupport, MergeNone},
+	{"command", -1, 0, 0, 0, CmdReadOnly | CmdNoSupport, MergeNone},
+	{"monitor", 1, 0, 0, 0, CmdReadOnly | CmdNoSupport, MergeNone},
+	{"debug", -2, 0, 0, 0, CmdWrite | CmdNoSupport, MergeNone},
+	{"save", 1, 0, 0, 0, CmdWrite | CmdNoSupport, MergeNone},
+	{"bgsave", -1, 0, 0, 0, CmdWrite | CmdNoSupport, MergeNone},
+	{"bgrewriteaof", 1, 0, 0, 0, CmdWrite | CmdNoSupport, MergeNone},
+	{"lastsave", 1, 0, 0, 0, CmdReadOnly | CmdNoSupport, MergeNone},
+	{"shutdown", -1, 0, 0, 0, CmdWrite | CmdNoSupport, MergeNone},
+	{"slaveof", 3, 0, 0, 0, CmdWrite | CmdNoSupport, MergeNone},
+	{"replicaof", 3, 0, 0, 0, CmdWrite | CmdNoSupport, MergeNone},
+	{"sync", 1, 0, 0, 0, CmdReadOnly | CmdNoSupport, MergeNone},
+	{"psync", -3, 0, 0, 0, CmdReadOnly | CmdNoSupport, MergeNone},
+}
+
+// Commands keyed by lowercase name.
+var commands = make(map[string]*Command, len(cmdTable))
+
+func init() {
+	for _, c := range cmdTable {
+		commands[c.Name] = c
+	}
+}
+
+// Returns the command named name in any case, nil for a command not in the
+// table.
+func LookupCmd(name []byte) *Command {
+	return commands[strings.ToLower(string(name))]
+}
+
+// CmdPolicy is what cfg lets clients run:
+//"deny_cmds":["flushdb"] refuses the commands listed,
+//"allow_cmds":["get","set"] refuses everything not listed, if set,
+//"broadcast_cmds":["flushdb"] enables broadcasting the write commands listed.
+type CmdPolicy struct {
+	deny      map[string]bool
+	allow     map[string]bool
+	broadcast map[string]bool
+}
+
+func NewCmdPolicy(cfg *util.Config) (p *CmdPolicy, err error) {
+	p = &CmdPolicy{}
+	if p.deny, err = cmdsList(cfg, "deny_cmds"); err != nil {
+		return nil, err
+	}
+	if p.allow, err = cmdsList(cfg, "allow_cmds"); err != nil {
+		return nil, err
+	}
+	if p.broadcast, err = cmdsList(cfg, "broadcast_cmds"); err != nil {
+		return nil, err
+	}
+	for name := range p.broadcast {
+		if c, ok := commands[name]; !ok || !c.Is(CmdBroadcast) {
+			return nil, ErrBadCmdsList
+		}
+	}
+
+	return
+}
+
+func cmdsList(cfg *util.Config, key string) (map[string]bool, error) {
+	list, ok := cfg.GetInterface(key).([]interface{})
+	if !ok && cfg.GetInterface(key) != nil {
+		return nil, ErrBadCmdsList
+	}
+
+	names := make(map[string]bool, len(list))
+	for _, v := range list {
+		name, ok := v.(string)
+		if !ok {
+			return nil, ErrBadCmdsList
+		}
+		names[strings.ToLower(name)] = true
+	}
+
+	return names, nil
+}
+
+// Returns whether the command, named name in lowercase, may be run. A write
+// command which is broadcast may only be run when broadcasting it is enabled.
+func (p *CmdPolicy) Allowed(name string, c *Command) bool {
+	if p.deny[name] || (len(p.allow) > 0 && !p.allow[name]) {
+		return false
+	}
+
+	return c == nil || !c.Is(CmdBroadcast) || !c.Is(CmdWrite) || p.broadcast[name]
+}
@@ -0,0 +1,26 @@
+package minproxy
+
+// CRC16-CCITT (XMODEM), the checksum Redis Cluster uses for key slots.
+var crc16Table [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func CRC16(buf []byte) (crc uint16) {
+	for _, b := range buf {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+
+	return
+}
@@ -0,0 +1,347 @@
+package minproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+const (
+	MigrateRunning = iota
+	MigrateDone
+	MigrateFailed
+
+	MigrateScanCount = "100"
+	MigrateTimeoutMs = "5000"
+	MigrateMaxPasses = 3
+)
+
+var (
+	ErrNotBucketRouter = errors.New("not bucket router err")
+	ErrBucketMigrating = errors.New("bucket migrating err")
+	ErrRouterChanged   = errors.New("router changed err")
+	ErrMigrateToUnix   = errors.New("can't migrate to a unix socket addr err")
+)
+
+var migrateStateStr = []string{"running", "done", "failed"}
+
+// Migration moves all keys of one bucket from its backend to another one.
+// While it runs, reads of the bucket are double routed: tried on the source,
+// then on the target if the source lacks the key. Any other request touching
+// the bucket first MIGRATEs its key from the source and is then routed to the
+// target, so no write lands on the target while an older value of the key is
+// still on the source. The scanner moves the rest in the background.
+type Migration struct {
+	Bucket int
+	From   string
+	To     string
+	Start  time.Time
+
+	state   int32
+	scanned int64
+	moved   int64
+	passes  int32
+	err     error
+	end     time.Time
+}
+
+func (m *Migration) State() int32 {
+	return atomic.LoadInt32(&m.state)
+}
+
+func (m *Migration) String() string {
+	str := fmt.Sprintf("bucket:%d from:%s to:%s state:%s pass:%d scanned:%d moved:%d",
+		m.Bucket, m.From, m.To, migrateStateStr[m.State()], atomic.LoadInt32(&m.passes),
+		atomic.LoadInt64(&m.scanned), atomic.LoadInt64(&m.moved))
+	if m.State() == MigrateRunning {
+		return str + " elapsed:" + time.Since(m.Start).String()
+	}
+	if m.err != nil {
+		str += " err:" + m.err.Error()
+	}
+
+	return str + " cost:" + m.end.Sub(m.Start).String()
+}
+
+// Starts moving the bucket to addr in the background.
+func (s *Server) MigrateBucket(bucket int, addr string) (m *Migration, err error) {
+	if strings.HasPrefix(addr, util.UnixPrefix) {
+		return nil, ErrMigrateToUnix
+	}
+	if _, ok := s.connPool.GetUintPool(addr); !ok {
+		if _, err = s.connPool.NewUnitPool(ConnSize, addr, ConnTimeout, ConnRetrys); err != nil {
+			return
+		}
+	}
+
+	s.bucketMux.Lock()
+	defer s.bucketMux.Unlock()
+	r, ok := s.router.(*BucketRouter)
+	if !ok {
+		return nil, ErrNotBucketRouter
+	}
+	from, ok := r.bucketAddrMap[bucket]
+	if !ok {
+		return nil, ErrBadBucketKey
+	}
+	if from == addr {
+		return nil, util.ErrSameAddr
+	}
+	if old, ok := s.migrations[bucket]; ok && old.State() == MigrateRunning {
+		return nil, ErrBucketMigrating
+	}
+
+	m = &Migration{Bucket: bucket, From: from, To: addr, Start: time.Now()}
+	s.migrations[bucket] = m
+	go s.runMigration(m, r)
+
+	return
+}
+
+// Returns all migrations, finished ones are kept until the bucket moves again.
+func (s *Server) Migrations() []*Migration {
+	s.bucketMux.RLock()
+	defer s.bucketMux.RUnlock()
+
+	ms := make([]*Migration, 0, len(s.migrations))
+	for _, m := range s.migrations {
+		ms = append(ms, m)
+	}
+
+	return ms
+}
+
+// Returns whether a migration runs, the caller holds bucketMux.
+func (s *Server) migrationRuns() bool {
+	for _, m := range s.migrations {
+		if m.State() == MigrateRunning {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns cfg with the buckets migrated since it was written moved, a cfg
+// file still gives them to the backend they were migrated from.
+func (s *Server) withMigrations(cfg *util.Config) *util.Config {
+	s.bucketMux.RLock()
+	defer s.bucketMux.RUnlock()
+
+	bucketAddrMap, _ := cfg.GetInterface("bucket_addr").(map[string]interface{})
+	for _, m := range s.migrations {
+		if m.State() != MigrateDone {
+			continue
+		}
+		if b, err := parseBackend(bucketAddrMap[strconv.Itoa(m.Bucket)]); err == nil && b.addr == m.From {
+			cfg = movedBucketCfg(cfg, m.Bucket, m.To)
+		}
+	}
+
+	return cfg
+}
+
+// Returns the running migration of the bucket the tag belongs to, the caller
+// holds bucketMux.
+func (s *Server) migrating(tag []byte) *Migration {
+	if len(s.migrations) == 0 {
+		return nil
+	}
+	r, ok := s.router.(*BucketRouter)
+	if !ok {
+		return nil
+	}
+	m, ok := s.migrations[r.Bucket(tag)]
+	if !ok || m.State() != MigrateRunning {
+		return nil
+	}
+
+	return m
+}
+
+func (s *Server) runMigration(m *Migration, r *BucketRouter) {
+	var err error
+	for pass := 0; pass < MigrateMaxPasses; pass++ {
+		atomic.AddInt32(&m.passes, 1)
+		moved := int64(0)
+		if moved, err = s.migratePass(m, r); err != nil || moved == 0 {
+			break
+		}
+	}
+
+	s.bucketMux.Lock()
+	if err == nil && s.router != r {
+		err = ErrRouterChanged
+	}
+	if err == nil {
+		r.bucketAddrMap[m.Bucket] = m.To
+		if s.cfg != nil {
+			s.cfg = movedBucketCfg(s.cfg, m.Bucket, m.To)
+		}
+	}
+	m.err, m.end = err, time.Now()
+	if err != nil {
+		atomic.StoreInt32(&m.state, MigrateFailed)
+	} else {
+		atomic.StoreInt32(&m.state, MigrateDone)
+	}
+	s.bucketMux.Unlock()
+}
+
+// Returns cfg with the "bucket_addr" entry of bucket set to addr, so applying
+// the running cfg again keeps the bucket where it was migrated to. The entry
+// of another bucket on addr is copied, its credential and TLS carry over.
+func movedBucketCfg(cfg *util.Config, bucket int, addr string) *util.Config {
+	bucketAddrMap, _ := cfg.GetInterface("bucket_addr").(map[string]interface{})
+	moved := make(map[string]interface{}, len(bucketAddrMap)+1)
+	var entry interface{} = addr
+	for b, v := range bucketAddrMap {
+		moved[b] = v
+		if be, err := parseBackend(v); err == nil && be.addr == addr {
+			entry = v
+		}
+	}
+	moved[strconv.Itoa(bucket)] = entry
+
+	cfg = cfg.Clone()
+	cfg.Set("bucket_addr", moved)
+
+	return cfg
+}
+
+// Scans the whole source once and moves the keys of the bucket, keys written
+// to the source while a pass runs are picked up by the next pass.
+func (s *Server) migratePass(m *Migration, r *BucketRouter) (moved int64, err error) {
+	host, port := splitAddr(m.To)
+	cursor := "0"
+	for {
+		resp, err := s.passCmd(m.From, "SCAN", cursor, "COUNT", MigrateScanCount)
+		if err != nil {
+			return moved, err
+		}
+		if resp.IsError() || len(resp.Elems) != 2 {
+			return moved, fmt.Errorf("scan %s, reply err:%s", m.From, resp.Val)
+		}
+		cursor = string(resp.Elems[0].Val)
+
+		args := append([]string{"MIGRATE", host, strconv.Itoa(port), "", "0", MigrateTimeoutMs, "REPLACE"}, m.authArgs(s)...)
+		args = append(args, "KEYS")
+		head := len(args)
+		for _, k := range resp.Elems[1].Elems {
+			if tag, err := GetHashTag(k.Val); err == nil && r.Bucket(tag) == m.Bucket {
+				args = append(args, string(k.Val))
+			}
+		}
+		atomic.AddInt64(&m.scanned, int64(len(resp.Elems[1].Elems)))
+		if keys := int64(len(args) - head); keys > 0 {
+			if resp, err = s.passCmd(m.From, args...); err != nil {
+				return moved, err
+			}
+			if resp.IsError() {
+				return moved, fmt.Errorf("migrate to %s, reply err:%s", m.To, resp.Val)
+			}
+			moved += keys
+			atomic.AddInt64(&m.moved, keys)
+		}
+
+		if cursor == "0" {
+			return moved, nil
+		}
+	}
+}
+
+// Runs a command of a pass within the request budget, MIGRATE gets the time
+// it gives the target on top.
+func (s *Server) passCmd(addr string, args ...string) (*Resp, error) {
+	s.bucketMux.RLock()
+	budget := s.timeouts.budget()
+	s.bucketMux.RUnlock()
+	ms, _ := strconv.Atoi(MigrateTimeoutMs)
+	ctx, cancel := context.WithTimeout(context.Background(), budget+time.Duration(ms)*time.Millisecond)
+	defer cancel()
+
+	return s.doCmd(ctx, addr, args...)
+}
+
+// Moves one key to the target before a request touching it is routed there,
+// within what is left of the budget of the request.
+func (m *Migration) moveKey(ctx context.Context, s *Server, key []byte) error {
+	host, port := splitAddr(m.To)
+	args := []string{"MIGRATE", host, strconv.Itoa(port), string(key), "0", MigrateTimeoutMs, "REPLACE"}
+	resp, err := s.doCmd(ctx, m.From, append(args, m.authArgs(s)...)...)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return errors.New(string(resp.Val))
+	}
+
+	return nil
+}
+
+// Returns the AUTH args the source passes MIGRATE to log in to the target
+// with the credential of the target, none if it has none.
+func (m *Migration) authArgs(s *Server) []string {
+	cred := s.connPool.Credential(m.To)
+	switch {
+	case cred == nil:
+		return nil
+	case cred.User != "":
+		return []string{"AUTH2", cred.User, cred.Password}
+	}
+
+	return []string{"AUTH", cred.Password}
+}
+
+// Returns whether the task is a plain single key read, which is double
+// routed while its bucket migrates.
+func (t *Task) doubleRoutable() bool {
+	return t.cmd != nil && t.cmd.Is(CmdReadOnly) && !t.cmd.Is(CmdBlocking|CmdBroadcast) && !t.isMulti() &&
+		len(t.OutInfos) == 1 && !t.sess.tx.multi && !txCmds[t.cmd.Name]
+}
+
+// Wraps a read of the bucket as MULTI EXISTS key <read> EXEC, sent to the
+// source. As long as the source holds the key its value is the newest one,
+// since a write moves the key first; a key it lacks is read on the target.
+func (m *Migration) doubleRoute(p *UnitPkg) {
+	p.fallback, p.plain, p.skip = m.To, p.data, 3 //+OK and two +QUEUED
+	p.data = Append([][]byte{PackCmd("MULTI"), PackCmd("EXISTS", string(p.rawKey)), p.data, PackCmd("EXEC")})
+}
+
+// Replaces the EXEC reply of a double routed read by the reply of the read,
+// fallback is kept only if the source lacked the key. A transaction refused
+// by the source is replied as is.
+func (p *UnitPkg) unwrapRead() {
+	if p.fallback == "" {
+		return
+	}
+	elems, err := SplitArray(p.data)
+	if err != nil || len(elems) != 2 {
+		p.fallback = ""
+		return
+	}
+	if string(elems[0]) != ":0\r\n" {
+		p.data, p.fallback = elems[1], ""
+	}
+}
+
+// Sends the double routed reads whose key the source lacked to the target.
+func (s *Server) readFallbacks(t *Task) {
+	for _, p := range t.OutInfos {
+		if p.fallback == "" || p.err != nil {
+			continue
+		}
+		s.connPool.PutConn(p.conn.Addr(), p.conn)
+		to := p.fallback
+		p.conn, p.data, p.skip, p.fallback = nil, p.plain, 0, ""
+		if s.sendTo(t.context(), p, to, t.Proto) == nil {
+			p.readReply(t.context(), t.Proto)
+		}
+	}
+}
@@ -3,10 +3,10 @@ package minproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
-	"io"
-	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/zimulala/minproxy/util"
@@ -25,32 +25,75 @@ var (
 	LineNumBytes  = []byte{'*'}
 	DataSizeBytes = []byte{'$'}
 	ArgSplitBytes = []byte("\r\n")
+	NullBulkBytes = []byte("$-1\r\n")
 )
 
 var (
 	ErrBadReqFormat = errors.New("bad req format err")
 	ErrBadArgsNum   = errors.New("bad args num err")
 	ErrReadConn     = errors.New("read conn err")
+	ErrBadReply     = errors.New("bad reply err")
+	ErrCrossSlot    = errors.New("CROSSSLOT Keys in request don't hash to the same backend")
 )
 
 var (
 	OpError uint8 = 0xFF
+	OpLocal uint8 = 0xFE
 )
 
 type UnitPkg struct {
 	conn     *util.Conn
 	uId      int
-	key      []byte
+	key      []byte //hashtag used for routing
+	rawKey   []byte
+	args     [][]byte //bulks of the key of a multi key command, the key and its value for mset
+	keyIdx   []int    //indexes of the keys a sub command of a multi key command holds
 	data     []byte
 	connAddr string
+	err      error
+	skip     int           //replies read and dropped before the one of the command
+	pinned   bool          //the conn is pinned by a transaction, it isn't put back
+	block    bool          //the conn is of the blocking pool
+	retry    []byte        //sent when the backend replies NOSCRIPT, loads the script and reruns data
+	replica  string        //the replica a read was sent to instead of the master
+	moved    bool          //the key is of a migrating bucket, read on a master since replicas may lag
+	fallback string        //the target a double routed read goes to once the source lacks the key
+	plain    []byte        //the read a double routed one wraps
+	breaker  *util.Breaker //of the backend, records the outcome once the reply is read
+	sentAt   time.Time
 }
 
+const (
+	MergeNone   = iota //single key command, the reply is passed through
+	MergeArray         //reply is an array holding one element per key
+	MergeOk            //every sub command replies +OK
+	MergeSum           //every sub command replies an integer, the sum is replied
+	MergeSame          //all keys must be on one backend, the command isn't split
+	MergeConcat        //the arrays replied by every backend are concatenated
+	MergeInfo          //INFO of the first backend with the keyspaces of all of them
+	MergeScan          //the cursor of the backend is turned into a proxy cursor
+	MergeFirst         //every backend replies the same, the first reply is used
+)
+
 type Task struct {
 	Opcode   uint8
 	Id       int64
+	Proto    int //RESP version of the client when the task was read
+	Cmd      []byte
 	OutInfos []*UnitPkg
 	Raw      [][]byte
 	Resp     *[]byte
+
+	sess  *Session
+	cmd   *Command //nil for a command not in the table
+	keys  int
+	nodes int //backends a broadcast command may go to
+
+	inTx    bool //sent on the conn pinned by a transaction, the reply is passed through
+	txAbort bool
+
+	ctx    context.Context //bounds the task from getting its conns to reading its replies
+	cancel context.CancelFunc
 }
 
 func (t *Task) IsErrTask() (err bool) {
@@ -69,24 +112,212 @@ func (t *Task) PackErrorReply(msg string) {
 	return
 }
 
-func (t *Task) getMKeys(e [][]byte) {
-	interval := 2
-	val := ArgSplitBytes
-	if string(e[2]) == "mset" {
-		interval = 4
+// The task is answered by the proxy itself, nothing is sent to backends.
+func (t *Task) IsLocalTask() bool {
+	return t.Opcode == OpLocal
+}
+
+func (t *Task) PackLocalReply(resp []byte) {
+	t.Opcode = OpLocal
+	t.OutInfos = nil
+	t.Resp = &resp
+
+	return
+}
+
+func PackStatus(s string) []byte {
+	return []byte("+" + s + "\r\n")
+}
+
+func PackInt(n int64) []byte {
+	return []byte(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func PackBulk(b []byte) []byte {
+	if b == nil {
+		return []byte("$-1\r\n")
+	}
+	buf := append([]byte("$"+strconv.Itoa(len(b))+"\r\n"), b...)
+
+	return append(buf, ArgSplitBytes...)
+}
+
+func PackArray(elems [][]byte) []byte {
+	buf := []byte("*" + strconv.Itoa(len(elems)) + "\r\n")
+	for _, e := range elems {
+		buf = append(buf, e...)
+	}
+
+	return buf
+}
+
+func (t *Task) isMulti() bool {
+	return t.cmd != nil && t.cmd.IsMulti()
+}
+
+// Returns the raws of the arg at pos, the command name is at 0.
+func (t *Task) arg(pos int) []byte {
+	return t.Raw[pos+1]
+}
+
+// Returns the positions of the first and the last key, first is -1 if the
+// args don't hold them. The keys of XREAD and XREADGROUP follow STREAMS and are
+// the first half of the args left, the ones of scripts follow numkeys.
+func (t *Task) keyRange() (first, last int) {
+	n := len(t.Raw) - 1
+	switch t.cmd.Name {
+	case "xread", "xreadgroup":
+		for i := 1; i < n; i++ {
+			if v, _ := GetVal(t.arg(i)); strings.EqualFold(string(v), "streams") {
+				return i + 1, i + (n-i-1)/2
+			}
+		}
+		return -1, -1
+	case "eval", "evalsha", "eval_ro", "evalsha_ro", "fcall", "fcall_ro":
+		return t.numKeys(2, 0)
+	case "zunion", "zinter", "zdiff", "zintercard", "sintercard", "lmpop", "zmpop":
+		return t.numKeys(1, 1)
+	case "zunionstore", "zinterstore", "zdiffstore", "blmpop", "bzmpop":
+		return t.numKeys(2, 1)
+	}
+
+	return t.cmd.keyRange(n)
+}
+
+// Returns the range of the keys following the numkeys arg at pos, at least
+// min of them.
+func (t *Task) numKeys(pos, min int) (first, last int) {
+	v, _ := GetVal(t.arg(pos))
+	keys, err := strconv.Atoi(string(v))
+	if err != nil || keys < min || pos+1+keys > len(t.Raw)-1 {
+		return -1, -1
+	}
+
+	return pos + 1, pos + keys
+}
+
+// Returns the positions of the keys before or after the key range: the
+// destination of ZUNIONSTORE and the like, the STORE and STOREDIST keys of
+// GEORADIUS. They are routed with the range but not split from the command.
+func (t *Task) extraKeys() (pos []int) {
+	n := len(t.Raw) - 1
+	switch t.cmd.Name {
+	case "zunionstore", "zinterstore", "zdiffstore":
+		return []int{1}
+	case "georadius", "georadiusbymember":
+		for i := 5; i < n-1; i++ { //the options follow the unit
+			if v, _ := GetVal(t.arg(i)); strings.EqualFold(string(v), "store") || strings.EqualFold(string(v), "storedist") {
+				pos = append(pos, i+1)
+			}
+		}
+	}
+
+	return
+}
+
+// HELP of a container command such as OBJECT has no key, it's routed by the
+// empty key like a script without keys.
+func (t *Task) keyless() bool {
+	switch t.cmd.Name {
+	case "object", "xinfo", "xgroup":
+		sub, _ := GetVal(t.arg(1))
+		return strings.EqualFold(string(sub), "help")
+	}
+
+	return false
+}
+
+// Returns how long a blocking command may block, 0 for ever. ok is false if
+// the command doesn't block: XREAD without BLOCK or a timeout not understood.
+func (t *Task) blockTimeout() (d time.Duration, ok bool) {
+	n := len(t.Raw) - 1
+	if t.cmd.Name == "xread" || t.cmd.Name == "xreadgroup" {
+		for i := 1; i < n-1; i++ {
+			if v, _ := GetVal(t.arg(i)); strings.EqualFold(string(v), "block") {
+				v, _ = GetVal(t.arg(i + 1))
+				ms, err := strconv.ParseInt(string(v), 10, 64)
+				return time.Duration(ms) * time.Millisecond, err == nil && ms >= 0
+			}
+		}
+		return 0, false
+	}
+
+	pos := n - 1
+	if t.cmd.Name == "blmpop" || t.cmd.Name == "bzmpop" { //the timeout precedes numkeys
+		pos = 1
+	}
+	v, _ := GetVal(t.arg(pos))
+	secs, err := strconv.ParseFloat(string(v), 64)
+
+	return time.Duration(secs * float64(time.Second)), err == nil && secs >= 0
+}
+
+// Splits a multi key command into one UnitPkg per key. A script without keys
+// gets one UnitPkg routed by the empty key, an extra key one without args.
+func (t *Task) getMKeys() (err error) {
+	first, last := t.keyRange()
+	step := t.cmd.Step
+	if first < 0 || last < first-1 || last >= len(t.Raw)-1 || (last-first+1)%step != 0 {
+		t.packArityErr()
+		return
 	}
 
-	begin := 3
-	t.OutInfos = make([]*UnitPkg, (len(e)-begin)/interval)
-	for i := begin; i < len(e); i += interval {
-		if interval == 4 {
-			val = append(bytes.Join([][]byte{e[i+2], e[i+3]}, ArgSplitBytes), ArgSplitBytes...)
+	t.keys = (last - first + 1) / step
+	if t.keys == 0 {
+		t.OutInfos = []*UnitPkg{{key: []byte{}}}
+		return
+	}
+	t.OutInfos = make([]*UnitPkg, 0, t.keys)
+	for i := first; i <= last; i += step {
+		key, err := GetVal(t.arg(i))
+		if err != nil {
+			return err
+		}
+		tag, err := GetHashTag(key)
+		if err != nil {
+			return err
+		}
+		t.OutInfos = append(t.OutInfos, &UnitPkg{uId: (i - first) / step, key: tag, rawKey: key, args: t.Raw[i+1 : i+1+step]})
+	}
+	for _, i := range t.extraKeys() {
+		key, err := GetVal(t.arg(i))
+		if err != nil {
+			return err
 		}
+		tag, err := GetHashTag(key)
+		if err != nil {
+			return err
+		}
+		t.OutInfos = append(t.OutInfos, &UnitPkg{uId: len(t.OutInfos), key: tag, rawKey: key})
+	}
+
+	return
+}
 
-		info := &UnitPkg{uId: i - begin, key: e[i+1],
-			data: bytes.Join([][]byte{[]byte("*3"), e[1], e[2], e[i], e[i+1], val}, ArgSplitBytes)}
-		t.OutInfos = append(t.OutInfos, info)
+// Groups the keys of a multi key command by the addr they are routed to, every
+// group becomes one sub command keeping the args before the first and after
+// the last key. Returns the addrs of the groups.
+func (t *Task) groupByAddr(addrs []string) (groupAddrs []string) {
+	first, last := t.keyRange()
+	head, tail := t.Raw[1:first+1], t.Raw[last+2:]
+	groups := make(map[string]*UnitPkg)
+	var infos []*UnitPkg
+	for i, info := range t.OutInfos {
+		g, ok := groups[addrs[i]]
+		if !ok {
+			g = &UnitPkg{uId: len(infos), key: info.key, args: append([][]byte{}, head...)}
+			groups[addrs[i]] = g
+			infos = append(infos, g)
+			groupAddrs = append(groupAddrs, addrs[i])
+		}
+		g.keyIdx = append(g.keyIdx, info.uId)
+		g.moved = g.moved || info.moved
+		g.args = append(g.args, info.args...)
+	}
+	for _, g := range infos {
+		g.data = PackArray(append(g.args, tail...))
 	}
+	t.OutInfos = infos
 
 	return
 }
@@ -115,175 +346,284 @@ func (t *Task) UnmarshalPkg() (err error) {
 		t.OutInfos = append(t.OutInfos, &UnitPkg{uId: 0, key: t.Raw[0], data: Append(t.Raw)})
 		return
 	}
-
-	lineN, err := strconv.Atoi(string(t.Raw[0][1 : len(t.Raw[0])-2]))
-	if err != nil {
+	if len(t.Raw) < 2 {
+		return ErrBadArgsNum
+	}
+	if t.Cmd, err = GetVal(t.Raw[1]); err != nil {
 		return
 	}
-	switch lineN <= 1 {
-	case true:
-		return ErrBadArgsNum
-	case false:
-		if len(t.Raw) < 3 {
-			return ErrBadArgsNum
-		}
-		if cmd, err := GetVal(t.Raw[1]); err != nil {
-			return err
-		} else if string(cmd) == "mset" || string(cmd) == "mget" {
-			t.getMKeys(t.Raw)
-			break
-		}
 
-		key, err := GetVal(t.Raw[2])
-		if err != nil {
-			return err
-		}
-		t.OutInfos = append(t.OutInfos, &UnitPkg{uId: 0, key: key, data: Append(t.Raw)})
-		if bytes.Contains(t.OutInfos[0].key, TagBeginByte) || bytes.Contains(t.OutInfos[0].key, TagEndBytes) {
-			start := bytes.Index(t.OutInfos[0].key, TagBeginByte)
-			end := bytes.Index(t.OutInfos[0].key, TagSplitByte)
-			if end < 0 {
-				end = bytes.Index(t.OutInfos[0].key, TagEndBytes)
-			}
-			if start < 0 || end < start {
-				return ErrBadReqFormat
-			}
-			t.OutInfos[0].key = t.OutInfos[0].key[start+1 : end]
-		}
+	//a command not in the table may have keys anywhere, it can't be routed
+	if t.cmd = LookupCmd(t.Cmd); t.cmd == nil {
+		t.PackErrorReply(ErrNoSupport.Error())
+		return
+	}
+	if !t.cmd.checkArity(len(t.Raw) - 1) {
+		t.packArityErr()
+		return
+	}
+	if t.cmd.Is(CmdNoSupport) {
+		t.PackErrorReply(ErrNoSupport.Error())
+		return
+	}
+	if t.cmd.FirstKey == 0 { //no key, answered by the proxy
+		return
+	}
+	if t.keyless() {
+		t.OutInfos = append(t.OutInfos, &UnitPkg{key: []byte{}, data: Append(t.Raw)})
+		return
+	}
+	if t.cmd.IsMulti() {
+		return t.getMKeys()
 	}
 
-	return
+	return t.getKey(t.cmd.FirstKey)
 }
 
-func (t *Task) MergeReplys() (err error) {
-	lines := len(t.OutInfos)
-	if lines == 1 {
-		if t.OutInfos[0].connAddr != ConnOkStr {
-			return ErrReadConn
-		}
-		t.Resp = &t.OutInfos[0].data
+func (t *Task) packArityErr() {
+	t.PackErrorReply("ERR wrong number of arguments for '" + t.cmd.Name + "' command")
+}
+
+// Routes the task by the key at pos, a subcommand missing its key such as
+// OBJECT ENCODING is answered with the arity err.
+func (t *Task) getKey(pos int) (err error) {
+	if pos >= len(t.Raw)-1 {
+		t.packArityErr()
 		return
 	}
-
-	*t.Resp = append(LineNumBytes, byte(lines))
-	for _, info := range t.OutInfos {
-		if info.connAddr != ConnOkStr {
-			return ErrReadConn
-		}
-		*t.Resp = append(*t.Resp, info.data...)
+	key, err := GetVal(t.arg(pos))
+	if err != nil {
+		return
+	}
+	tag, err := GetHashTag(key)
+	if err != nil {
+		return
 	}
+	t.OutInfos = append(t.OutInfos, &UnitPkg{uId: 0, key: tag, rawKey: key, data: Append(t.Raw)})
 
 	return
 }
 
-func readBulk(r *bufio.Reader, d []byte, data *[]byte) (err error) {
-	bufL, err := strconv.Atoi(string(d[1 : len(d)-2]))
-	if err != nil {
-		return err
-	}
-	if bufL < 0 {
-		return
+// Returns the part of the key used for routing: "tag" for "{tag}key" or
+// "{tag,xx}key", the whole key if it has no tag.
+func GetHashTag(key []byte) ([]byte, error) {
+	if !bytes.Contains(key, TagBeginByte) && !bytes.Contains(key, TagEndBytes) {
+		return key, nil
 	}
 
-	buf, err := r.ReadBytes('\n')
-	if err == nil {
-		*data = append(*data, buf...)
+	start := bytes.Index(key, TagBeginByte)
+	end := bytes.Index(key, TagSplitByte)
+	if end < 0 {
+		end = bytes.Index(key, TagEndBytes)
+	}
+	if start < 0 || end < start {
+		return nil, ErrBadReqFormat
 	}
 
-	return
+	return key[start+1 : end], nil
 }
 
-func (p *UnitPkg) ReadReply() (err error) {
-	p.conn.SetReadDeadline(time.Now().Add(ConnReadDeadline * time.Second))
-	if p.data, err = p.conn.ReadBytes('\n'); err != nil {
-		return
+func (t *Task) MergeReplys() (err error) {
+	if t.txAbort {
+		return ErrExecAbort
 	}
-	if !bytes.HasPrefix(p.data, LineNumBytes) && !bytes.HasPrefix(p.data, DataSizeBytes) {
-		return
+	merge := MergeNone
+	if t.cmd != nil && !t.inTx {
+		merge = t.cmd.Merge
 	}
-	if bytes.HasPrefix(p.data, DataSizeBytes) {
-		readBulk(p.conn.R, p.data, &p.data)
+
+	switch merge {
+	case MergeArray:
+		return t.mergeArray()
+	case MergeOk:
+		return t.mergeOk()
+	case MergeSum:
+		return t.mergeSum()
+	case MergeConcat:
+		return t.mergeConcat()
+	case MergeInfo:
+		return t.mergeInfo()
+	case MergeScan:
+		return t.mergeScan()
+	case MergeFirst:
+		return t.mergeFirst()
+	default: //the keys of MergeSame are on one backend
+		if t.OutInfos[0].err != nil {
+			return t.OutInfos[0].err
+		}
+		t.Resp = &t.OutInfos[0].data
 		return
 	}
-
-	return p.readReplyData()
 }
 
-func (p *UnitPkg) readReplyData() (err error) {
-	lines, err := strconv.Atoi(string((p.data)[1 : len(p.data)-2]))
-	if err != nil {
-		return
+// Puts the elements of the sub replies back in key order. Keys of a sub
+// command which failed get its error as their element.
+func (t *Task) mergeArray() error {
+	elems := make([][]byte, t.keys)
+	for _, info := range t.OutInfos {
+		subElems, err := info.subReply()
+		if err == nil && len(subElems) != len(info.keyIdx) {
+			err = ErrBadReply
+		}
+		for j, idx := range info.keyIdx {
+			if err != nil {
+				elems[idx] = []byte("-" + err.Error() + "\r\n")
+				continue
+			}
+			elems[idx] = subElems[j]
+		}
 	}
+	resp := PackArray(elems)
+	t.Resp = &resp
 
-	for i := 0; i < lines; i++ {
-		buf, err := p.conn.ReadBytes('\n')
-		if err != nil {
-			return err
+	return nil
+}
+
+// Replies the first error of the sub replies, +OK if there is none.
+func (t *Task) mergeOk() error {
+	for _, info := range t.OutInfos {
+		if info.err != nil {
+			return info.err
+		}
+		if info.data[0] == '-' {
+			t.Resp = &info.data
+			return nil
 		}
-		p.data = append(p.data, buf...)
+	}
+	resp := PackStatus("OK")
+	t.Resp = &resp
 
-		if bytes.HasPrefix(buf, DataSizeBytes) {
-			readBulk(p.conn.R, buf, &p.data)
-			continue
+	return nil
+}
+
+// Replies the first reply, or the first error of any backend.
+func (t *Task) mergeFirst() error {
+	for _, info := range t.OutInfos {
+		if info.err != nil {
+			return info.err
+		}
+		if info.data[0] == '-' {
+			t.Resp = &info.data
+			return nil
 		}
+	}
+	if len(t.OutInfos) == 0 {
+		return ErrBadReply
+	}
+	t.Resp = &t.OutInfos[0].data
 
-		if bytes.HasPrefix(buf, LineNumBytes) {
-			i = -1
-			lines, err = strconv.Atoi(string(buf[1 : len(buf)-2]))
+	return nil
+}
+
+// Replies the sum of the integers the sub commands replied, or the first error.
+func (t *Task) mergeSum() error {
+	sum := int64(0)
+	for _, info := range t.OutInfos {
+		if info.err != nil {
+			return info.err
+		}
+		if info.data[0] == '-' {
+			t.Resp = &info.data
+			return nil
+		}
+		if info.data[0] != ':' {
+			return ErrBadReply
+		}
+		n, err := strconv.ParseInt(string(info.data[1:len(info.data)-2]), 10, 64)
+		if err != nil {
+			return ErrBadReply
 		}
+		sum += n
 	}
+	resp := PackInt(sum)
+	t.Resp = &resp
 
-	return
+	return nil
 }
 
-func readLine(r *bufio.Reader) (b []byte, err error) {
-	if b, err = r.ReadBytes('\n'); err != nil {
-		return
+// Returns the elements of the array a sub command replied, an error reply is
+// returned as error.
+func (p *UnitPkg) subReply() ([][]byte, error) {
+	if p.err != nil {
+		return nil, p.err
 	}
-	l := len(b) - 2
-	if l < 0 || b[l] != '\r' {
-		err = ErrBadReqFormat
+	if p.data[0] == '-' {
+		return nil, errors.New(string(p.data[1 : len(p.data)-2]))
 	}
 
+	return SplitArray(p.data)
+}
+
+// Reads the reply and converts it to proto, push frames sent by the backend
+// on its own are skipped. The read is given up once ctx is done.
+func (p *UnitPkg) ReadReply(ctx context.Context, proto int) (err error) {
+	deadline, _ := ctx.Deadline()
+	p.conn.SetReadDeadline(deadline)
+	//a cancel ends the read by moving its deadline
+	done := make(chan Sigal)
+	stop := context.AfterFunc(ctx, func() {
+		p.conn.SetReadDeadline(time.Now())
+		close(done)
+	})
+	defer func() {
+		if !stop() {
+			<-done
+		}
+	}()
+
+	for {
+		if p.data, err = ReadRaw(p.conn.R, nil); err != nil {
+			return
+		}
+		if p.data[0] == '>' {
+			continue
+		}
+		if p.skip == 0 {
+			break
+		}
+		p.skip--
+	}
+	p.data, err = ConvertRaw(p.data, p.conn.Proto, proto)
+
 	return
 }
 
-//*3\r\n$6\r\nGETSET\r\n$3\r\nkey\r\n$0\r\n\r\n
+// *3\r\n$6\r\nGETSET\r\n$3\r\nkey\r\n$0\r\n\r\n
+// raws[0] is the "*3\r\n" line, every other raw is a whole bulk.
 func ReadReqData(r *bufio.Reader) (raws [][]byte, err error) {
 	buf, err := readLine(r)
 	if err != nil || len(buf) <= 2 {
 		return
 	}
-	lines, err := strconv.Atoi(string(buf[1 : len(buf)-2]))
-	if err != nil || lines < 0 {
-		return
-	}
 
 	switch buf[0] {
-	case '+', '-', ':':
-		err = ErrBadReqFormat
 	case '$':
 		raws = make([][]byte, 1)
-		s := len(buf)
-		raws[0] = make([]byte, s+lines+2)
-		copy(raws[0][:s], buf)
-		if _, err = io.ReadFull(r, raws[0][s:s+lines]); err != nil {
+		if raws[0], err = readRawFrom(r, buf, nil); err != nil {
 			return nil, err
 		}
-		if b, err := readLine(r); err != nil || len(b) != 2 {
+	case '*':
+		lines, err := parseLen(buf, MaxArrayLen)
+		if err != nil || lines < 0 {
 			return nil, err
-		} else {
-			copy(raws[0][(s+lines):(s+lines+2)], b)
 		}
-	case '*':
 		raws = make([][]byte, lines+1)
 		raws[0] = buf
 		for i := 1; i <= lines; i++ {
-			raw, err := ReadReqData(r)
-			if err != nil || len(raw) <= 0 {
+			//only bulks are read, anything else is refused before its body is
+			line, err := readLine(r)
+			if err != nil {
+				return nil, err
+			}
+			if line[0] != '$' {
+				return nil, ErrBadReqFormat
+			}
+			if raws[i], err = readRawFrom(r, line, nil); err != nil {
 				return nil, err
 			}
-			raws[i] = raw[0]
+			if bytes.HasPrefix(raws[i], NullBulkBytes) {
+				return nil, ErrBadReqFormat
+			}
 		}
 	case 'P':
 		raws = make([][]byte, 1)
@@ -294,9 +634,3 @@ func ReadReqData(r *bufio.Reader) (raws [][]byte, err error) {
 
 	return
 }
-
-func Write(c *net.TCPConn, buf []byte) (err error) {
-	_, err = c.Write(buf)
-
-	return
-}
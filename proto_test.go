@@ -0,0 +1,270 @@
+package minproxy
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadResp(t *testing.T) {
+	data := "*2\r\n$1\r\n0\r\n*3\r\n$3\r\na\nb\r\n$-1\r\n:7\r\n"
+	resp, err := ReadResp(bufio.NewReader(bytes.NewBufferString(data)))
+	if err != nil {
+		t.Fatalf("read resp err:%v", err)
+	}
+	if resp.Type != '*' || len(resp.Elems) != 2 || string(resp.Elems[0].Val) != "0" {
+		t.Fatalf("resp:%+v", resp)
+	}
+	elems := resp.Elems[1].Elems
+	if len(elems) != 3 || string(elems[0].Val) != "a\nb" || !elems[1].Null {
+		t.Fatalf("elems:%+v", elems)
+	}
+	if n, err := elems[2].Int(); err != nil || n != 7 {
+		t.Errorf("int:%d err:%v", n, err)
+	}
+
+	if string(PackCmd("GET", "foo")) != "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" {
+		t.Errorf("pack cmd:%q", PackCmd("GET", "foo"))
+	}
+}
+
+var rawTests = []string{
+	"+OK\r\n",
+	"-ERR unknown command\r\n",
+	":1000\r\n",
+	"$-1\r\n",
+	"$0\r\n\r\n",
+	"$6\r\nfoo\nba\r\n",
+	"*-1\r\n",
+	"*0\r\n",
+	"*2\r\n*3\r\n:1\r\n$1\r\na\r\n*1\r\n+x\r\n$4\r\nb\r\nc\r\n",
+	"*3\r\n+QUEUED\r\n*2\r\n$1\r\n0\r\n*2\r\n$1\r\nk\r\n$-1\r\n:1\r\n",
+	"_\r\n",
+	",3.14\r\n",
+	"#t\r\n",
+	"(3492890328409238509324850943850943825024385\r\n",
+	"=8\r\ntxt:a\r\nb\r\n",
+	"!5\r\nERR x\r\n",
+	"%2\r\n+a\r\n:1\r\n$1\r\nb\r\n~1\r\n#f\r\n",
+	"|1\r\n+ttl\r\n:3\r\n$1\r\nv\r\n",
+	">2\r\n$7\r\nmessage\r\n_\r\n",
+}
+
+var convertTests = []struct {
+	resp3 string
+	resp2 string
+}{
+	{"_\r\n", "$-1\r\n"},
+	{",3.14\r\n", "$4\r\n3.14\r\n"},
+	{"#f\r\n", ":0\r\n"},
+	{"=8\r\ntxt:a\r\nb\r\n", "$4\r\na\r\nb\r\n"},
+	{"!6\r\nERR\r\nx\r\n", "-ERR  x\r\n"},
+	{"%1\r\n+a\r\n~2\r\n:1\r\n#t\r\n", "*2\r\n+a\r\n*2\r\n:1\r\n:1\r\n"},
+	{"|1\r\n+ttl\r\n:3\r\n$1\r\nv\r\n", "$1\r\nv\r\n"},
+}
+
+func TestConvertRaw(t *testing.T) {
+	for _, tt := range convertTests {
+		if raw, err := ConvertRaw([]byte(tt.resp3), Resp3, Resp2); err != nil || string(raw) != tt.resp2 {
+			t.Errorf("downgrade:%q, got:%q err:%v", tt.resp3, raw, err)
+		}
+		if raw, err := ConvertRaw([]byte(tt.resp3), Resp2, Resp3); err != nil || string(raw) != tt.resp3 {
+			t.Errorf("reencode:%q, got:%q err:%v", tt.resp3, raw, err)
+		}
+	}
+
+	if raw, _ := ConvertRaw([]byte("*2\r\n$-1\r\n*-1\r\n"), Resp2, Resp3); string(raw) != "*2\r\n_\r\n_\r\n" {
+		t.Errorf("upgrade nulls, got:%q", raw)
+	}
+}
+
+func TestReadRaw(t *testing.T) {
+	for _, data := range rawTests {
+		//a trailing value must not be consumed
+		r := bufio.NewReader(bytes.NewBufferString(data + "+NEXT\r\n"))
+		raw, err := ReadRaw(r, nil)
+		if err != nil || string(raw) != data {
+			t.Errorf("read raw:%q, got:%q err:%v", data, raw, err)
+		}
+		if next, err := ReadRaw(r, nil); err != nil || string(next) != "+NEXT\r\n" {
+			t.Errorf("read raw after:%q, got:%q err:%v", data, next, err)
+		}
+	}
+
+	for _, data := range []string{"$3\r\nfoo", "$3\r\nfooo\r\n", "*2\r\n:1\r\n", "?\r\n", "$-2\r\n", ":1\n"} {
+		if raw, err := ReadRaw(bufio.NewReader(bytes.NewBufferString(data)), nil); err == nil {
+			t.Errorf("read raw:%q, got:%q", data, raw)
+		}
+	}
+}
+
+func TestReadReqData(t *testing.T) {
+	for _, tt := range writeTests {
+		raws, err := ReadReqData(bufio.NewReader(bytes.NewBufferString(tt.data)))
+		if err != nil || string(Append(raws)) != tt.data || len(raws) != len(tt.args)+1 {
+			t.Errorf("read req:%q, got:%q err:%v", tt.data, raws, err)
+		}
+	}
+
+	data := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\na\r\nb\n\r\n"
+	raws, err := ReadReqData(bufio.NewReader(bytes.NewBufferString(data)))
+	if err != nil || len(raws) != 4 || string(raws[3]) != "$5\r\na\r\nb\n\r\n" {
+		t.Errorf("read req:%q, got:%q err:%v", data, raws, err)
+	}
+
+	//a nested element is refused at its first line
+	data = "*2\r\n$3\r\nGET\r\n" + strings.Repeat("*1\r\n", 1<<20)
+	sr := strings.NewReader(data)
+	if raws, err = ReadReqData(bufio.NewReader(sr)); err != ErrBadReqFormat || sr.Len() == 0 {
+		t.Errorf("read nested req, got:%q err:%v", raws, err)
+	}
+}
+
+func TestReadNested(t *testing.T) {
+	for _, depth := range []int{MaxNesting, MaxNesting + 1, 1 << 20} {
+		data := strings.Repeat("*1\r\n", depth) + ":1\r\n"
+		want := error(nil)
+		if depth > MaxNesting {
+			want = ErrBadReqFormat
+		}
+		if _, err := ReadRaw(bufio.NewReader(strings.NewReader(data)), nil); err != want {
+			t.Errorf("read raw nested:%d, got err:%v", depth, err)
+		}
+		if _, err := ReadResp(bufio.NewReader(strings.NewReader(data))); err != want {
+			t.Errorf("read resp nested:%d, got err:%v", depth, err)
+		}
+	}
+}
+
+func FuzzReadReqData(f *testing.F) {
+	for _, tt := range writeTests {
+		f.Add([]byte(tt.data))
+	}
+	f.Add([]byte("PING\r\n"))
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n*1\r\n$1\r\nk\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		raws, err := ReadReqData(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil || len(raws) == 0 {
+			return
+		}
+		buf := Append(raws)
+		if !bytes.HasPrefix(data, buf) {
+			t.Fatalf("raws:%q are not a prefix of:%q", raws, data)
+		}
+		again, err := ReadReqData(bufio.NewReader(bytes.NewReader(buf)))
+		if err != nil || !bytes.Equal(Append(again), buf) {
+			t.Fatalf("reread:%q, got:%q err:%v", buf, again, err)
+		}
+	})
+}
+
+func FuzzReadRaw(f *testing.F) {
+	for _, data := range rawTests {
+		f.Add([]byte(data))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		raw, err := ReadRaw(bufio.NewReader(bytes.NewReader(data)), nil)
+		resp, respErr := ReadResp(bufio.NewReader(bytes.NewReader(data)))
+		if (err == nil) != (respErr == nil) {
+			t.Fatalf("data:%q, read raw err:%v, read resp err:%v", data, err, respErr)
+		}
+		if err != nil {
+			return
+		}
+		if !bytes.HasPrefix(data, raw) || (resp.Type != raw[0] && raw[0] != '|') {
+			t.Fatalf("data:%q, raw:%q resp:%+v", data, raw, resp)
+		}
+	})
+}
+
+func TestUnmarshalPkg(t *testing.T) {
+	task := newTask("MGet", "a", "b")
+	if err := task.UnmarshalPkg(); err != nil || !task.isMulti() || len(task.OutInfos) != 2 {
+		t.Fatalf("mget cmd:%v err:%v", task.cmd, err)
+	}
+
+	task = newTask("GET", "{tag}k")
+	if err := task.UnmarshalPkg(); err != nil || string(task.OutInfos[0].key) != "tag" ||
+		string(task.OutInfos[0].rawKey) != "{tag}k" {
+		t.Fatalf("get err:%v", err)
+	}
+
+	task = newTask("object", "encoding", "k")
+	if err := task.UnmarshalPkg(); err != nil || string(task.OutInfos[0].key) != "k" {
+		t.Fatalf("object err:%v", err)
+	}
+
+	task = newTask("get", "a", "b")
+	if err := task.UnmarshalPkg(); err != nil || string(*task.Resp) != "-ERR wrong number of arguments for 'get' command\r\n" {
+		t.Fatalf("get arity err:%v", err)
+	}
+
+	task = newTask("SELECT", "1")
+	if err := task.UnmarshalPkg(); err != nil || string(*task.Resp) != "-"+ErrNoSupport.Error()+"\r\n" {
+		t.Fatalf("select err:%v", err)
+	}
+
+	//keys might be anywhere in a command not in the table
+	task = newTask("NOPE", "a", "b")
+	if err := task.UnmarshalPkg(); err != nil || string(*task.Resp) != "-"+ErrNoSupport.Error()+"\r\n" || len(task.OutInfos) != 0 {
+		t.Fatalf("unknown cmd err:%v", err)
+	}
+
+	for _, c := range []struct {
+		args []string
+		keys string
+	}{
+		{[]string{"ZUNIONSTORE", "d", "2", "a", "b", "WEIGHTS", "1", "2"}, "a b d"},
+		{[]string{"ZINTERSTORE", "d", "1", "a"}, "a d"},
+		{[]string{"ZDIFFSTORE", "d", "2", "a", "b"}, "a b d"},
+		{[]string{"ZRANGESTORE", "d", "a", "0", "-1"}, "d a"},
+		{[]string{"ZUNION", "2", "a", "b", "WITHSCORES"}, "a b"},
+		{[]string{"ZINTER", "1", "a"}, "a"},
+		{[]string{"ZDIFF", "2", "a", "b"}, "a b"},
+		{[]string{"SINTERCARD", "2", "a", "b", "LIMIT", "1"}, "a b"},
+		{[]string{"ZINTERCARD", "2", "a", "b"}, "a b"},
+		{[]string{"LMPOP", "2", "a", "b", "LEFT"}, "a b"},
+		{[]string{"BLMPOP", "0", "2", "a", "b", "LEFT"}, "a b"},
+		{[]string{"ZMPOP", "1", "a", "MIN"}, "a"},
+		{[]string{"BZMPOP", "1.5", "1", "a", "MAX"}, "a"},
+		{[]string{"GEORADIUS", "a", "15", "37", "200", "km", "STORE", "s", "STOREDIST", "d"}, "a s d"},
+		{[]string{"GEORADIUSBYMEMBER", "a", "store", "200", "km"}, "a"},
+		{[]string{"GEOSEARCHSTORE", "d", "a", "FROMMEMBER", "m", "BYRADIUS", "1", "km"}, "d a"},
+	} {
+		task = newTask(c.args...)
+		if err := task.UnmarshalPkg(); err != nil || task.Resp != nil {
+			t.Fatalf("%v err:%v", c.args, err)
+		}
+		var keys []string
+		for _, info := range task.OutInfos {
+			keys = append(keys, string(info.rawKey))
+		}
+		if strings.Join(keys, " ") != c.keys {
+			t.Errorf("%v keys:%v", c.args, keys)
+		}
+		//the keys are on one backend, the command is sent as it is
+		task.groupByAddr(make([]string, len(task.OutInfos)))
+		if string(task.OutInfos[0].data) != string(PackCmd(c.args...)) {
+			t.Errorf("%v sub command:%q", c.args, task.OutInfos[0].data)
+		}
+	}
+	for _, args := range [][]string{{"ZUNIONSTORE", "d", "0", "a"}, {"ZUNION", "3", "a", "b"}, {"LMPOP", "x", "a", "LEFT"}} {
+		task = newTask(args...)
+		if err := task.UnmarshalPkg(); err != nil || task.Resp == nil || !strings.Contains(string(*task.Resp), "wrong number of arguments") {
+			t.Errorf("%v err:%v", args, err)
+		}
+	}
+
+	//the timeout is kept after the keys of every sub command
+	task = newTask("BLPOP", "a", "c", "0")
+	if err := task.UnmarshalPkg(); err != nil || len(task.OutInfos) != 2 || !task.cmd.Is(CmdBlocking) {
+		t.Fatalf("blpop err:%v", err)
+	}
+	task.groupByAddr([]string{"a", "a"})
+	if string(task.OutInfos[0].data) != string(PackCmd("BLPOP", "a", "c", "0")) {
+		t.Fatalf("blpop sub command:%q", task.OutInfos[0].data)
+	}
+}
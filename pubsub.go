@@ -0,0 +1,298 @@
+package minproxy
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+// Commands a RESP2 client may run while it is subscribed.
+var subscribedCmds = map[string]bool{
+	"subscribe": true, "psubscribe": true, "unsubscribe": true, "punsubscribe": true, "ping": true,
+}
+
+// PubSub is the subscribe state of a client conn. Every backend its channels
+// or patterns live on gets a dedicated conn which is never pooled, a reader
+// per conn streams the messages to the client as they arrive.
+type PubSub struct {
+	sess     *Session
+	mux      sync.Mutex
+	proto    int
+	connPool *util.ConnPool        //dials the dedicated conns
+	conns    map[string]*util.Conn //key: addr
+	channels map[string]string     //channel -> addr
+	patterns map[string]bool
+}
+
+func newPubSub(sess *Session) *PubSub {
+	return &PubSub{
+		sess:     sess,
+		conns:    make(map[string]*util.Conn),
+		channels: make(map[string]string),
+		patterns: make(map[string]bool)}
+}
+
+// Returns the number of channels and patterns, the caller holds mux.
+func (ps *PubSub) count() int {
+	return len(ps.channels) + len(ps.patterns)
+}
+
+// Sends the command on the dedicated conn of addr, dialing it on first use
+// within the budget of the request. The caller holds mux.
+func (ps *PubSub) send(ctx context.Context, addr string, args ...string) (err error) {
+	c, ok := ps.conns[addr]
+	if !ok {
+		if c, err = ps.connPool.DialContext(ctx, addr, timeLeft(ctx)); err != nil {
+			return
+		}
+		ps.conns[addr] = c
+		go ps.read(c)
+	}
+	if err = c.Write(PackCmd(args...)); err != nil {
+		ps.closeConn(addr)
+	}
+
+	return
+}
+
+// Drops the conn of addr and the channels living on it, the caller holds mux.
+func (ps *PubSub) closeConn(addr string) {
+	if c, ok := ps.conns[addr]; ok {
+		c.Close()
+		delete(ps.conns, addr)
+	}
+	for ch, a := range ps.channels {
+		if a == addr {
+			delete(ps.channels, ch)
+		}
+	}
+}
+
+// Closes the dedicated conns once nothing is subscribed, the caller holds mux.
+func (ps *PubSub) closeIfEmpty() {
+	if ps.count() == 0 {
+		for addr := range ps.conns {
+			ps.closeConn(addr)
+		}
+	}
+}
+
+// Forwards the messages read from c, the subscribe confirmations of the
+// backend are dropped since the proxy replies its own.
+func (ps *PubSub) read(c *util.Conn) {
+	for {
+		raw, err := ReadRaw(c.R, nil)
+		if err != nil {
+			ps.mux.Lock()
+			if ps.conns[c.Addr()] == c {
+				log.Println("pubsub read, addr:", c.Addr(), " err:", err)
+				ps.closeConn(c.Addr())
+			}
+			ps.mux.Unlock()
+			return
+		}
+		elems, err := SplitArray(raw)
+		if err != nil || len(elems) < 3 {
+			continue
+		}
+		if kind, _ := GetVal(elems[0]); string(kind) != "message" && string(kind) != "pmessage" {
+			continue
+		}
+
+		ps.mux.Lock()
+		if ps.proto == Resp3 {
+			raw[0] = '>'
+		}
+		ps.mux.Unlock()
+		ps.sess.push(raw)
+	}
+}
+
+// Closes all dedicated conns, the client is back in normal mode.
+func (ps *PubSub) Close() {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	for addr := range ps.conns {
+		ps.closeConn(addr)
+	}
+	ps.patterns = make(map[string]bool)
+}
+
+func (ps *PubSub) confirm(kind string, name []byte) []byte {
+	ch := &Resp{Type: '$', Val: name, Null: name == nil}
+	count := &Resp{Type: ':', Val: []byte(strconv.Itoa(ps.count()))}
+
+	return (&Resp{Type: '>', Elems: []*Resp{bulkResp(kind), ch, count}}).Encode(ps.proto)
+}
+
+// SUBSCRIBE channel [channel ...]
+// A channel lives on the backend its name is routed to, like PUBLISH.
+func (s *Server) handleSubscribe(t *Task) {
+	chs, err := GetVals(t.Raw[2:])
+	if err != nil {
+		t.PackErrorReply(err.Error())
+		return
+	}
+	ps := t.sess.pubSub()
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	ps.proto, ps.connPool = t.Proto, s.connPool
+
+	byAddr := make(map[string][]string)
+	var resp []byte
+	for _, ch := range chs {
+		if _, ok := ps.channels[string(ch)]; !ok {
+			tag, err := GetHashTag(ch)
+			if err != nil {
+				t.PackErrorReply(err.Error())
+				return
+			}
+			s.bucketMux.RLock()
+			addr, err := s.router.GetAddr(tag)
+			s.bucketMux.RUnlock()
+			if err != nil {
+				t.PackErrorReply(err.Error())
+				return
+			}
+			ps.channels[string(ch)] = addr
+			byAddr[addr] = append(byAddr[addr], string(ch))
+		}
+		resp = append(resp, ps.confirm("subscribe", ch)...)
+	}
+	for addr, names := range byAddr {
+		if err = ps.send(t.context(), addr, append([]string{"SUBSCRIBE"}, names...)...); err != nil {
+			break
+		}
+		delete(byAddr, addr)
+	}
+	if err != nil {
+		//the channels not subscribed on their backend are dropped
+		for _, names := range byAddr {
+			for _, ch := range names {
+				delete(ps.channels, ch)
+			}
+		}
+		ps.closeIfEmpty()
+		t.PackErrorReply(ErrWriteToConn.Error())
+		return
+	}
+	t.PackLocalReply(resp)
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+// A pattern may match channels of any backend, so it is subscribed on all.
+func (s *Server) handlePsubscribe(t *Task) {
+	pats, err := GetVals(t.Raw[2:])
+	if err != nil {
+		t.PackErrorReply(err.Error())
+		return
+	}
+	ps := t.sess.pubSub()
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	ps.proto, ps.connPool = t.Proto, s.connPool
+
+	var names []string
+	var resp []byte
+	for _, pat := range pats {
+		if !ps.patterns[string(pat)] {
+			ps.patterns[string(pat)] = true
+			names = append(names, string(pat))
+		}
+		resp = append(resp, ps.confirm("psubscribe", pat)...)
+	}
+	if len(names) > 0 {
+		s.bucketMux.RLock()
+		addrs := s.router.Addrs()
+		s.bucketMux.RUnlock()
+		for i, addr := range addrs {
+			if err = ps.send(t.context(), addr, append([]string{"PSUBSCRIBE"}, names...)...); err != nil {
+				//the patterns are dropped from the backends they were sent to
+				for _, pat := range names {
+					delete(ps.patterns, pat)
+				}
+				for _, a := range addrs[:i] {
+					ps.send(t.context(), a, append([]string{"PUNSUBSCRIBE"}, names...)...)
+				}
+				ps.closeIfEmpty()
+				t.PackErrorReply(ErrWriteToConn.Error())
+				return
+			}
+		}
+	}
+	t.PackLocalReply(resp)
+}
+
+// UNSUBSCRIBE [channel [channel ...]]
+func (s *Server) handleUnsubscribe(t *Task) {
+	t.sess.unsubscribe(t, false)
+}
+
+// PUNSUBSCRIBE [pattern [pattern ...]]
+func (s *Server) handlePunsubscribe(t *Task) {
+	t.sess.unsubscribe(t, true)
+}
+
+// Unsubscribes the channels or patterns given, all of them if none is. Once
+// nothing is left the dedicated conns are closed.
+func (sess *Session) unsubscribe(t *Task, pattern bool) {
+	names, err := GetVals(t.Raw[2:])
+	if err != nil {
+		t.PackErrorReply(err.Error())
+		return
+	}
+	ps := sess.pubSub()
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	ps.proto = t.Proto
+
+	kind, cmd := "unsubscribe", "UNSUBSCRIBE"
+	if pattern {
+		kind, cmd = "punsubscribe", "PUNSUBSCRIBE"
+	}
+	if len(names) == 0 {
+		if pattern {
+			for pat := range ps.patterns {
+				names = append(names, []byte(pat))
+			}
+		} else {
+			for ch := range ps.channels {
+				names = append(names, []byte(ch))
+			}
+		}
+	}
+	if len(names) == 0 {
+		t.PackLocalReply(ps.confirm(kind, nil))
+		return
+	}
+
+	var resp []byte
+	for _, name := range names {
+		if addr, ok := ps.channels[string(name)]; ok && !pattern {
+			delete(ps.channels, string(name))
+			ps.send(t.context(), addr, cmd, string(name))
+		} else if ps.patterns[string(name)] && pattern {
+			delete(ps.patterns, string(name))
+			for addr := range ps.conns {
+				ps.send(t.context(), addr, cmd, string(name))
+			}
+		}
+		resp = append(resp, ps.confirm(kind, name)...)
+	}
+	ps.closeIfEmpty()
+	t.PackLocalReply(resp)
+}
+
+// Returns whether a RESP2 client in subscribed mode may run the command.
+func (sess *Session) allowed(t *Task) bool {
+	if t.Proto != Resp2 || !sess.subscribed() {
+		return true
+	}
+
+	return t.Cmd == nil || subscribedCmds[strings.ToLower(string(t.Cmd))]
+}
@@ -0,0 +1,122 @@
+package minproxy
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+const (
+	ReadMaster           = "master"
+	ReadRoundRobin       = "round_robin"
+	ReadLeastOutstanding = "least_outstanding"
+)
+
+var ErrBadReadPolicy = errors.New("bad read policy err")
+
+// Replicas are the replica groups of cfg, a "bucket_addr" entry of
+// {"addr":"master:6379","replicas":["replica:6379"]} makes a group. Reads of
+// a group go to its replicas picked by "read_policy":
+//"round_robin" takes them in turn, the default,
+//"least_outstanding" takes the one with the fewest reads in flight,
+//"master" keeps sending reads to the master.
+// While all replicas of a group are down its reads go to the master.
+type Replicas struct {
+	policy string
+	groups map[string][]string //master -> replicas
+	next   map[string]*uint32  //master -> turn
+}
+
+func NewReplicas(cfg *util.Config, backends map[string]backend) (r *Replicas, err error) {
+	r = &Replicas{policy: cfg.GetString("read_policy"), groups: make(map[string][]string), next: make(map[string]*uint32)}
+	switch r.policy {
+	case "":
+		r.policy = ReadRoundRobin
+	case ReadMaster, ReadRoundRobin, ReadLeastOutstanding:
+	default:
+		return nil, ErrBadReadPolicy
+	}
+	for addr, b := range backends {
+		if len(b.replicas) > 0 {
+			r.groups[addr], r.next[addr] = b.replicas, new(uint32)
+		}
+	}
+
+	return
+}
+
+// Returns the addrs of all replicas.
+func (r *Replicas) Addrs() (addrs []string) {
+	if r == nil {
+		return
+	}
+	for _, replicas := range r.groups {
+		addrs = append(addrs, replicas...)
+	}
+
+	return uniqAddrs(addrs)
+}
+
+// Returns the replica a read of master goes to, "" for the master itself.
+// Replicas which are down are skipped, load returns the reads in flight.
+func (r *Replicas) pick(master string, down func(string) bool, load func(string) int64) string {
+	if r == nil || r.policy == ReadMaster || len(r.groups[master]) == 0 {
+		return ""
+	}
+
+	replicas := r.groups[master]
+	start := int(atomic.AddUint32(r.next[master], 1))
+	picked, min := "", int64(-1)
+	for i := range replicas {
+		addr := replicas[(start+i)%len(replicas)]
+		if down(addr) {
+			continue
+		}
+		if r.policy == ReadRoundRobin {
+			return addr
+		}
+		if n := load(addr); min < 0 || n < min {
+			picked, min = addr, n
+		}
+	}
+
+	return picked
+}
+
+// Returns the backends of router and their replicas.
+func allAddrs(router Router, replicas *Replicas) []string {
+	return uniqAddrs(append(router.Addrs(), replicas.Addrs()...))
+}
+
+// Sends the reads of the task whose backend has replicas to one of them.
+// Called once the sub commands are built, addrs holds their backends. A key
+// just migrated is read on the master, its replicas may not have it yet.
+func (s *Server) routeReads(t *Task, addrs []string) {
+	s.bucketMux.RLock()
+	r := s.replicas
+	s.bucketMux.RUnlock()
+
+	for i, addr := range addrs {
+		if t.OutInfos[i].moved {
+			continue
+		}
+		if replica := r.pick(addr, s.connPool.Down, s.outstanding); replica != "" {
+			addrs[i], t.OutInfos[i].replica = replica, replica
+			s.addOutstanding(replica, 1)
+		}
+	}
+}
+
+func (s *Server) outstanding(addr string) int64 {
+	if n, ok := s.reads.Load(addr); ok {
+		return atomic.LoadInt64(n.(*int64))
+	}
+
+	return 0
+}
+
+func (s *Server) addOutstanding(addr string, delta int64) {
+	n, _ := s.reads.LoadOrStore(addr, new(int64))
+	atomic.AddInt64(n.(*int64), delta)
+}
@@ -0,0 +1,391 @@
+package minproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+const (
+	MaxBulkLen  = 512 * 1024 * 1024
+	MaxArrayLen = 1024 * 1024
+	ReadChunk   = 64 * 1024
+	MaxNesting  = 128 //aggregates a value may be nested in
+)
+
+const (
+	Resp2 = 2
+	Resp3 = 3
+)
+
+// Resp is a decoded RESP value, used where the proxy talks to backends on
+// its own behalf or has to convert a reply between RESP2 and RESP3.
+type Resp struct {
+	Type  byte    //RESP2: '+', '-', ':', '$', '*'; RESP3 adds '_', ',', '#', '(', '=', '!', '%', '~', '>'
+	Val   []byte  //line of a simple type, payload of a bulk, verbatim string or blob error
+	Elems []*Resp //elements of an aggregate, a map holds key and value pairs in a row
+	Attrs []*Resp //RESP3 attribute sent ahead of the value
+	Null  bool    //$-1, *-1 or _
+}
+
+func (r *Resp) IsError() bool {
+	return r.Type == '-'
+}
+
+func (r *Resp) Int() (int64, error) {
+	return strconv.ParseInt(string(r.Val), 10, 64)
+}
+
+func readLine(r *bufio.Reader) (b []byte, err error) {
+	if b, err = r.ReadBytes('\n'); err != nil {
+		return
+	}
+	l := len(b) - 2
+	if l < 0 || b[l] != '\r' {
+		err = ErrBadReqFormat
+	}
+
+	return
+}
+
+// Returns how many values follow an aggregate of n elements.
+func elemNum(typ byte, n int) int {
+	if typ == '%' || typ == '|' {
+		return 2 * n
+	}
+
+	return n
+}
+
+// Parses the length of a "$n\r\n" or "*n\r\n" line, -1 is null.
+func parseLen(line []byte, max int) (n int, err error) {
+	if n, err = strconv.Atoi(string(line[1 : len(line)-2])); err != nil {
+		return
+	}
+	if n < -1 || n > max {
+		err = ErrBadReqFormat
+	}
+
+	return
+}
+
+// Appends the n bytes of a bulk and its "\r\n" to buf, a chunk at a time so a
+// bogus length can't allocate more than what is actually sent.
+func readBulkData(r *bufio.Reader, buf []byte, n int) ([]byte, error) {
+	for n += 2; n > 0; {
+		chunk := n
+		if chunk > ReadChunk {
+			chunk = ReadChunk
+		}
+		l := len(buf)
+		buf = append(buf, make([]byte, chunk)...)
+		if _, err := io.ReadFull(r, buf[l:]); err != nil {
+			return nil, err
+		}
+		n -= chunk
+	}
+	if !bytes.HasSuffix(buf, ArgSplitBytes) {
+		return nil, ErrBadReqFormat
+	}
+
+	return buf, nil
+}
+
+// Appends the next RESP2 or RESP3 value read from r to buf as it is on the
+// wire. Bulks are read by their declared length, so they may hold any byte,
+// and nested aggregates are read recursively up to MaxNesting deep. An
+// attribute is read together with the value following it.
+func ReadRaw(r *bufio.Reader, buf []byte) ([]byte, error) {
+	return readRaw(r, buf, 0)
+}
+
+func readRaw(r *bufio.Reader, buf []byte, depth int) ([]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return readRawAt(r, line, buf, depth)
+}
+
+// Same as ReadRaw, the first line of the value is already read.
+func readRawFrom(r *bufio.Reader, line, buf []byte) ([]byte, error) {
+	return readRawAt(r, line, buf, 0)
+}
+
+// depth is the number of aggregates the value is in.
+func readRawAt(r *bufio.Reader, line, buf []byte, depth int) (_ []byte, err error) {
+	if len(line) < 3 {
+		return nil, ErrBadReqFormat
+	}
+	buf = append(buf, line...)
+
+	switch line[0] {
+	case '+', '-', ':', '_', ',', '#', '(':
+	case '$', '=', '!':
+		n, err := parseLen(line, MaxBulkLen)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 0 {
+			return readBulkData(r, buf, n)
+		}
+	case '*', '%', '~', '>', '|':
+		n, err := parseLen(line, MaxArrayLen)
+		if err != nil {
+			return nil, err
+		}
+		if depth >= MaxNesting {
+			return nil, ErrBadReqFormat
+		}
+		for i := 0; i < elemNum(line[0], n); i++ {
+			if buf, err = readRaw(r, buf, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		if line[0] == '|' {
+			return readRaw(r, buf, depth+1)
+		}
+	default:
+		return nil, ErrBadReqFormat
+	}
+
+	return buf, nil
+}
+
+// Decodes the next value read from r, nested up to MaxNesting deep like
+// ReadRaw.
+func ReadResp(r *bufio.Reader) (resp *Resp, err error) {
+	return readResp(r, 0)
+}
+
+func readResp(r *bufio.Reader, depth int) (resp *Resp, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return
+	}
+	if len(line) < 3 {
+		return nil, ErrBadReqFormat
+	}
+
+	resp = &Resp{Type: line[0], Val: line[1 : len(line)-2]}
+	switch resp.Type {
+	case '+', '-', ':', ',', '#', '(':
+	case '_':
+		resp.Null, resp.Val = true, nil
+	case '$', '=', '!':
+		n, err := parseLen(line, MaxBulkLen)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			resp.Null, resp.Val = true, nil
+			break
+		}
+		if resp.Val, err = readBulkData(r, nil, n); err != nil {
+			return nil, err
+		}
+		resp.Val = resp.Val[:n]
+	case '*', '%', '~', '>', '|':
+		n, err := parseLen(line, MaxArrayLen)
+		if err != nil {
+			return nil, err
+		}
+		if depth >= MaxNesting {
+			return nil, ErrBadReqFormat
+		}
+		if n < 0 {
+			resp.Null, resp.Val = true, nil
+			break
+		}
+		for i := 0; i < elemNum(resp.Type, n); i++ {
+			elem, err := readResp(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			resp.Elems = append(resp.Elems, elem)
+		}
+		if resp.Type == '|' {
+			attrs := resp.Elems
+			if resp, err = readResp(r, depth+1); err != nil {
+				return nil, err
+			}
+			resp.Attrs = append(attrs, resp.Attrs...)
+		}
+	default:
+		err = ErrBadReqFormat
+	}
+
+	return
+}
+
+// Encodes the value for a client speaking proto. RESP3 only types are turned
+// into their RESP2 counterparts and attributes are dropped for RESP2, nulls
+// become "_" for RESP3.
+func (r *Resp) Encode(proto int) []byte {
+	if r.Null {
+		switch {
+		case proto == Resp3:
+			return []byte("_\r\n")
+		case r.Type == '*':
+			return []byte("*-1\r\n")
+		default:
+			return NullBulkBytes
+		}
+	}
+
+	var buf []byte
+	if proto == Resp3 && len(r.Attrs) > 0 {
+		buf = r.packAggregate('|', r.Attrs, proto)
+	}
+	switch r.Type {
+	case '+', '-', ':':
+		buf = append(buf, r.Type)
+		buf = append(buf, r.Val...)
+		return append(buf, ArgSplitBytes...)
+	case ',', '#', '(':
+		if proto == Resp3 {
+			buf = append(buf, r.Type)
+			buf = append(buf, r.Val...)
+			return append(buf, ArgSplitBytes...)
+		}
+		if r.Type == '#' {
+			if string(r.Val) == "t" {
+				return append(buf, PackInt(1)...)
+			}
+			return append(buf, PackInt(0)...)
+		}
+		return append(buf, PackBulk(r.Val)...)
+	case '=':
+		if proto == Resp3 {
+			return append(buf, packLen('=', len(r.Val), r.Val)...)
+		}
+		if len(r.Val) >= 4 && r.Val[3] == ':' { //"txt:..."
+			return append(buf, PackBulk(r.Val[4:])...)
+		}
+		return append(buf, PackBulk(r.Val)...)
+	case '!':
+		if proto == Resp3 {
+			return append(buf, packLen('!', len(r.Val), r.Val)...)
+		}
+		msg := bytes.Replace(bytes.Replace(r.Val, []byte("\r"), []byte(" "), -1), []byte("\n"), []byte(" "), -1)
+		return append(append(append(buf, '-'), msg...), ArgSplitBytes...)
+	case '$':
+		return append(buf, PackBulk(r.Val)...)
+	case '%', '~', '>':
+		if proto == Resp3 {
+			return append(buf, r.packAggregate(r.Type, r.Elems, proto)...)
+		}
+	}
+
+	return append(buf, r.packAggregate('*', r.Elems, proto)...)
+}
+
+func (r *Resp) packAggregate(typ byte, elems []*Resp, proto int) []byte {
+	n := len(elems)
+	if typ == '%' || typ == '|' {
+		n /= 2
+	}
+	buf := packLen(typ, n, nil)
+	for _, e := range elems {
+		buf = append(buf, e.Encode(proto)...)
+	}
+
+	return buf
+}
+
+// Packs "<typ><n>\r\n" followed by the payload of a length prefixed type.
+func packLen(typ byte, n int, payload []byte) []byte {
+	buf := append([]byte{typ}, strconv.Itoa(n)...)
+	buf = append(buf, ArgSplitBytes...)
+	if payload == nil {
+		return buf
+	}
+	buf = append(buf, payload...)
+
+	return append(buf, ArgSplitBytes...)
+}
+
+// Converts a raw reply read from a backend speaking from into what a client
+// speaking to expects.
+func ConvertRaw(raw []byte, from, to int) ([]byte, error) {
+	if from == to {
+		return raw, nil
+	}
+	resp, err := ReadResp(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Encode(to), nil
+}
+
+// Returns the raw elements of a raw array.
+func SplitArray(raw []byte) (elems [][]byte, err error) {
+	r := bufio.NewReader(bytes.NewReader(raw))
+	line, err := readLine(r)
+	if err != nil {
+		return
+	}
+	if line[0] != '*' && line[0] != '~' && line[0] != '>' {
+		return nil, ErrBadReply
+	}
+	n, err := parseLen(line, MaxArrayLen)
+	if err != nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		elem, err := ReadRaw(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+	}
+
+	return
+}
+
+// Packs a command as an array of bulks.
+func PackCmd(args ...string) []byte {
+	elems := make([][]byte, len(args))
+	for i, arg := range args {
+		elems[i] = PackBulk([]byte(arg))
+	}
+
+	return PackArray(elems)
+}
+
+// Runs one command on a pooled conn of addr and decodes the reply, giving up
+// once ctx is done.
+func (s *Server) doCmd(ctx context.Context, addr string, args ...string) (resp *Resp, err error) {
+	c, err := s.connPool.GetConnContext(ctx, addr)
+	if err == util.ErrBackendDown || err == util.ErrCtxDone || err == util.ErrPoolFull {
+		return nil, ctxErr(ctx, err) //no slot was taken
+	} else if err != nil {
+		s.connPool.PutConn(addr, nil)
+		return nil, ctxErr(ctx, err)
+	}
+
+	if err = negotiate(ctx, c, Resp2); err == nil {
+		deadline := time.Now().Add(timeLeft(ctx))
+		c.SetReadDeadline(deadline)
+		c.SetWriteDeadline(deadline)
+		err = c.Write(PackCmd(args...))
+		c.SetWriteDeadline(time.Time{})
+	}
+	if err == nil {
+		resp, err = ReadResp(c.R)
+	}
+	if err != nil {
+		c.Close()
+		c = nil
+	}
+	s.connPool.PutConn(addr, c)
+
+	return resp, ctxErr(ctx, err)
+}
@@ -0,0 +1,372 @@
+package minproxy
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+const (
+	RouterBucket = "bucket"
+	RouterKetama = "ketama"
+	RouterSlot   = "slot"
+
+	KetamaPointsPerHash = 4
+	KetamaHashesPerNode = 40
+
+	SlotCount = 16384
+)
+
+var (
+	ErrUnknownRouter = errors.New("unknown router err")
+	ErrNoNodes       = errors.New("no nodes err")
+	ErrNoPoints      = errors.New("ketama ring has no points err")
+	ErrBadBackendCfg = errors.New("bad backend addr err")
+)
+
+// Router maps a (hashtag extracted) key to the addr of the backend owning it.
+type Router interface {
+	Name() string
+	GetAddr(key []byte) (string, error)
+	Addrs() []string
+}
+
+// Builds the router selected by the "router" config key, "bucket" by default.
+func NewRouter(cfg *util.Config) (Router, error) {
+	switch name := cfg.GetString("router"); name {
+	case "", RouterBucket:
+		return NewBucketRouter(cfg)
+	case RouterKetama:
+		return NewKetamaRouter(cfg)
+	case RouterSlot:
+		return NewSlotRouter(cfg)
+	default:
+		return nil, fmt.Errorf("%v, router:%s", ErrUnknownRouter, name)
+	}
+}
+
+func uniqAddrs(addrs []string) (uniq []string) {
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if !seen[addr] {
+			seen[addr] = true
+			uniq = append(uniq, addr)
+		}
+	}
+	sort.Strings(uniq)
+
+	return
+}
+
+// backend is how the conns of a backend are dialed.
+type backend struct {
+	addr     string
+	cred     *util.Credential //AUTH sent on every new conn, nil for none
+	tls      bool             //dialed with the backend TLS config of cfg
+	replicas []string         //dialed like the backend
+}
+
+// Parses a backend entry of cfg, either "host:port" or
+// {"addr":"host:port","user":"proxy","password":"secret","tls":true,
+// "replicas":["host:port"]}.
+func parseBackend(v interface{}) (b backend, err error) {
+	switch v := v.(type) {
+	case string:
+		b.addr = v
+	case map[string]interface{}:
+		b.addr, _ = v["addr"].(string)
+		b.tls, _ = v["tls"].(bool)
+		user, _ := v["user"].(string)
+		pass, _ := v["password"].(string)
+		if user != "" && pass == "" {
+			return b, ErrBadBackendCfg
+		}
+		if pass != "" {
+			b.cred = &util.Credential{User: user, Password: pass}
+		}
+		replicas, _ := v["replicas"].([]interface{})
+		for _, r := range replicas {
+			addr, _ := r.(string)
+			if addr == "" {
+				return b, ErrBadBackendCfg
+			}
+			b.replicas = append(b.replicas, addr)
+		}
+	}
+	if b.addr == "" {
+		return b, ErrBadBackendCfg
+	}
+
+	return
+}
+
+// Returns the backends of "bucket_addr" and their replicas keyed by addr.
+func backendsOf(cfg *util.Config) (backends map[string]backend, err error) {
+	backends = make(map[string]backend)
+	bucketAddrMap, _ := cfg.GetInterface("bucket_addr").(map[string]interface{})
+	for _, v := range bucketAddrMap {
+		b, err := parseBackend(v)
+		if err != nil {
+			return nil, err
+		}
+		backends[b.addr] = b
+		for _, addr := range b.replicas {
+			backends[addr] = backend{addr: addr, cred: b.cred, tls: b.tls}
+		}
+	}
+
+	return
+}
+
+// BucketRouter sums the key bytes and takes the sum modulo the bucket count
+// to pick an entry of bucketAddrMap.
+type BucketRouter struct {
+	bucketBase    int
+	buckets       []int
+	bucketAddrMap map[int]string //key: bucket, val: serverAddr
+}
+
+func NewBucketRouter(cfg *util.Config) (r *BucketRouter, err error) {
+	r = &BucketRouter{bucketBase: cfg.GetInt("bucket_base"), bucketAddrMap: make(map[int]string)}
+	for _, b := range cfg.GetArray("buckets") {
+		r.buckets = append(r.buckets, int(b.(float64)))
+	}
+	bucketAddrMap, _ := cfg.GetInterface("bucket_addr").(map[string]interface{})
+	for b, v := range bucketAddrMap {
+		bInt, err := strconv.Atoi(b)
+		if err != nil {
+			return nil, err
+		}
+		b, err := parseBackend(v)
+		if err != nil {
+			return nil, err
+		}
+		r.bucketAddrMap[bInt] = b.addr
+	}
+
+	if r.bucketBase <= 0 || len(r.buckets) < r.bucketBase || len(r.bucketAddrMap) == 0 {
+		return nil, ErrBadConfig
+	}
+
+	return
+}
+
+func (r *BucketRouter) Name() string {
+	return RouterBucket
+}
+
+func (r *BucketRouter) Bucket(key []byte) int {
+	w := int64(0)
+	for _, k := range key {
+		w += int64(k)
+	}
+
+	return int(w % int64(len(r.buckets)/r.bucketBase))
+}
+
+func (r *BucketRouter) GetAddr(key []byte) (string, error) {
+	addr, ok := r.bucketAddrMap[r.Bucket(key)]
+	if !ok {
+		return "", ErrBadBucketKey
+	}
+
+	return addr, nil
+}
+
+func (r *BucketRouter) Addrs() []string {
+	addrs := make([]string, 0, len(r.bucketAddrMap))
+	for _, addr := range r.bucketAddrMap {
+		addrs = append(addrs, addr)
+	}
+
+	return uniqAddrs(addrs)
+}
+
+type ketamaPoint struct {
+	hash uint32
+	addr string
+}
+
+type ketamaPoints []ketamaPoint
+
+func (p ketamaPoints) Len() int           { return len(p) }
+func (p ketamaPoints) Less(i, j int) bool { return p[i].hash < p[j].hash }
+func (p ketamaPoints) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// KetamaRouter is a consistent hash ring, every node owns
+// weight*KetamaHashesPerNode*KetamaPointsPerHash virtual points on it.
+//
+//"router":"ketama",
+//"nodes":{"127.0.0.1:6379":1,"127.0.0.1:6380":2}
+type KetamaRouter struct {
+	weights map[string]int
+	points  ketamaPoints
+}
+
+func NewKetamaRouter(cfg *util.Config) (r *KetamaRouter, err error) {
+	nodes, _ := cfg.GetInterface("nodes").(map[string]interface{})
+	weights := make(map[string]int, len(nodes))
+	for addr, w := range nodes {
+		weight, ok := w.(float64)
+		if !ok || weight < 1 || weight != float64(int(weight)) { //a fraction would be truncated
+			return nil, fmt.Errorf("%v, node:%s weight:%v", ErrBadConfig, addr, w)
+		}
+		weights[addr] = int(weight)
+	}
+
+	return NewKetamaRouterWithWeights(weights)
+}
+
+func NewKetamaRouterWithWeights(weights map[string]int) (r *KetamaRouter, err error) {
+	if len(weights) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	r = &KetamaRouter{weights: weights}
+	for addr, weight := range weights {
+		for i := 0; i < weight*KetamaHashesPerNode; i++ {
+			digest := md5.Sum([]byte(addr + "-" + strconv.Itoa(i)))
+			for j := 0; j < KetamaPointsPerHash; j++ {
+				r.points = append(r.points, ketamaPoint{hash: binary.LittleEndian.Uint32(digest[j*4:]), addr: addr})
+			}
+		}
+	}
+	if len(r.points) == 0 { //every weight is 0 or less
+		return nil, ErrNoPoints
+	}
+	sort.Sort(r.points)
+
+	return
+}
+
+func (r *KetamaRouter) Name() string {
+	return RouterKetama
+}
+
+func (r *KetamaRouter) GetAddr(key []byte) (string, error) {
+	digest := md5.Sum(key)
+	h := binary.LittleEndian.Uint32(digest[:4])
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].addr, nil
+}
+
+func (r *KetamaRouter) Addrs() []string {
+	addrs := make([]string, 0, len(r.weights))
+	for addr := range r.weights {
+		addrs = append(addrs, addr)
+	}
+
+	return uniqAddrs(addrs)
+}
+
+type SlotRange struct {
+	Start int
+	End   int
+	Addr  string
+}
+
+type slotRanges []SlotRange
+
+func (r slotRanges) Len() int           { return len(r) }
+func (r slotRanges) Less(i, j int) bool { return r[i].Start < r[j].Start }
+func (r slotRanges) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// SlotRouter routes like Redis Cluster, CRC16(key) mod 16384 picks a slot
+// and every backend owns some slot ranges.
+//
+//"router":"slot",
+//"slot_addr":{"0-8191":"127.0.0.1:6379","8192-16383":"127.0.0.1:6380"}
+type SlotRouter struct {
+	ranges slotRanges
+	slots  [SlotCount]string
+}
+
+func NewSlotRouter(cfg *util.Config) (r *SlotRouter, err error) {
+	slotAddrMap, _ := cfg.GetInterface("slot_addr").(map[string]interface{})
+	ranges := make([]SlotRange, 0, len(slotAddrMap))
+	for rangeStr, addr := range slotAddrMap {
+		sr, err := parseSlotRange(rangeStr)
+		if err != nil {
+			return nil, err
+		}
+		if sr.Addr, _ = addr.(string); sr.Addr == "" {
+			return nil, fmt.Errorf("%v, slot range:%s", ErrBadConfig, rangeStr)
+		}
+		ranges = append(ranges, sr)
+	}
+
+	return NewSlotRouterWithRanges(ranges)
+}
+
+//"0-8191" or "8192"
+func parseSlotRange(s string) (sr SlotRange, err error) {
+	bounds := strings.SplitN(s, "-", 2)
+	if sr.Start, err = strconv.Atoi(bounds[0]); err != nil {
+		return
+	}
+	sr.End = sr.Start
+	if len(bounds) == 2 {
+		sr.End, err = strconv.Atoi(bounds[1])
+	}
+
+	return
+}
+
+// Every slot has to be owned by exactly one backend.
+func NewSlotRouterWithRanges(ranges []SlotRange) (r *SlotRouter, err error) {
+	r = &SlotRouter{ranges: ranges}
+	sort.Sort(r.ranges)
+	for _, sr := range r.ranges {
+		if sr.Start < 0 || sr.End >= SlotCount || sr.Start > sr.End {
+			return nil, fmt.Errorf("%v, slot range:%d-%d", ErrBadConfig, sr.Start, sr.End)
+		}
+		for i := sr.Start; i <= sr.End; i++ {
+			if r.slots[i] != "" {
+				return nil, fmt.Errorf("%v, slot:%d assigned twice", ErrBadConfig, i)
+			}
+			r.slots[i] = sr.Addr
+		}
+	}
+	for i, addr := range r.slots {
+		if addr == "" {
+			return nil, fmt.Errorf("%v, slot:%d not assigned", ErrBadConfig, i)
+		}
+	}
+
+	return
+}
+
+func Slot(key []byte) int {
+	return int(CRC16(key)) % SlotCount
+}
+
+func (r *SlotRouter) Name() string {
+	return RouterSlot
+}
+
+func (r *SlotRouter) GetAddr(key []byte) (string, error) {
+	return r.slots[Slot(key)], nil
+}
+
+func (r *SlotRouter) Addrs() []string {
+	addrs := make([]string, 0, len(r.ranges))
+	for _, sr := range r.ranges {
+		addrs = append(addrs, sr.Addr)
+	}
+
+	return uniqAddrs(addrs)
+}
+
+func (r *SlotRouter) Ranges() []SlotRange {
+	return r.ranges
+}
@@ -0,0 +1,106 @@
+package minproxy
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+func TestKetamaRouter(t *testing.T) {
+	weights := map[string]int{"127.0.0.1:6379": 1, "127.0.0.1:6380": 1, "127.0.0.1:6381": 1}
+	r, err := NewKetamaRouterWithWeights(weights)
+	if err != nil {
+		t.Fatalf("new ketama router err:%v", err)
+	}
+
+	keys := 10000
+	owners := make(map[string]string, keys)
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := "key:" + strconv.Itoa(i)
+		addr, _ := r.GetAddr([]byte(key))
+		owners[key] = addr
+		counts[addr]++
+	}
+	for addr, c := range counts {
+		if c < keys/len(weights)/2 {
+			t.Errorf("addr:%s owns too few keys:%d", addr, c)
+		}
+	}
+
+	//adding a node should only move the keys it takes over
+	weights["127.0.0.1:6382"] = 1
+	if r, err = NewKetamaRouterWithWeights(weights); err != nil {
+		t.Fatalf("new ketama router err:%v", err)
+	}
+	moved := 0
+	for key, owner := range owners {
+		addr, _ := r.GetAddr([]byte(key))
+		if addr == owner {
+			continue
+		}
+		if addr != "127.0.0.1:6382" {
+			t.Errorf("key:%s moved from %s to %s", key, owner, addr)
+		}
+		moved++
+	}
+	if moved > keys/2 {
+		t.Errorf("too many keys moved:%d", moved)
+	}
+
+	//a weight giving a node no points is refused
+	for _, nodes := range []string{`{"127.0.0.1:6379":0.5}`, `{"127.0.0.1:6379":1.5}`, `{"127.0.0.1:6379":0}`} {
+		if _, err = NewKetamaRouter(util.LoadConfigString(`{"nodes":` + nodes + `}`)); err == nil {
+			t.Errorf("nodes:%s no err", nodes)
+		}
+	}
+	if _, err = NewKetamaRouterWithWeights(map[string]int{"127.0.0.1:6379": 0}); err != ErrNoPoints {
+		t.Errorf("ring without points err:%v", err)
+	}
+}
+
+func TestBucketRouter(t *testing.T) {
+	r := &BucketRouter{bucketBase: 2, buckets: []int{0, 0, 1, 1},
+		bucketAddrMap: map[int]string{0: "127.0.0.1:6379", 1: "127.0.0.1:6380"}}
+
+	if addr, err := r.GetAddr([]byte("a")); err != nil || addr != "127.0.0.1:6380" {
+		t.Errorf("get addr, addr:%s err:%v", addr, err)
+	}
+	if addrs := r.Addrs(); len(addrs) != 2 {
+		t.Errorf("addrs:%v", addrs)
+	}
+}
+
+func TestSlotRouter(t *testing.T) {
+	if crc := CRC16([]byte("123456789")); crc != 0x31C3 {
+		t.Errorf("crc16:%x", crc)
+	}
+	if slot := Slot([]byte("foo")); slot != 12182 {
+		t.Errorf("slot:%d", slot)
+	}
+
+	if _, err := NewSlotRouterWithRanges([]SlotRange{{0, 8191, "127.0.0.1:6379"}}); err == nil {
+		t.Error("unassigned slots should be rejected")
+	}
+	r, err := NewSlotRouterWithRanges([]SlotRange{{8192, 16383, "127.0.0.1:6380"}, {0, 8191, "127.0.0.1:6379"}})
+	if err != nil {
+		t.Fatalf("new slot router err:%v", err)
+	}
+	if addr, _ := r.GetAddr([]byte("foo")); addr != "127.0.0.1:6380" {
+		t.Errorf("get addr:%s", addr)
+	}
+
+	srv := &Server{router: r}
+	task := &Task{Raw: [][]byte{[]byte("*3\r\n"), []byte("$7\r\nCLUSTER\r\n"), []byte("$7\r\nKEYSLOT\r\n"), []byte("$8\r\n{foo}bar\r\n")}}
+	srv.handleCluster(task)
+	if !task.IsLocalTask() || string(*task.Resp) != ":12182\r\n" {
+		t.Errorf("cluster keyslot reply:%q", *task.Resp)
+	}
+	task.Raw[2] = []byte("$5\r\nSLOTS\r\n")
+	srv.handleCluster(task)
+	if !task.IsLocalTask() || !strings.HasPrefix(string(*task.Resp), "*2\r\n*3\r\n:0\r\n:8191\r\n*3\r\n$9\r\n127.0.0.1\r\n:6379\r\n") {
+		t.Errorf("cluster slots reply:%q", *task.Resp)
+	}
+}
@@ -0,0 +1,94 @@
+package minproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+const ScriptCacheSize = 1024
+
+var NoScriptBytes = []byte("-NOSCRIPT")
+
+// scriptCache holds the bodies of the scripts seen by EVAL or SCRIPT LOAD
+// keyed by their SHA1, so a backend replying NOSCRIPT to EVALSHA gets the
+// script loaded and the EVALSHA rerun.
+type scriptCache struct {
+	mux    sync.RWMutex
+	bodies map[string][]byte
+}
+
+func (c *scriptCache) add(body []byte) {
+	sum := sha1.Sum(body)
+	sha := hex.EncodeToString(sum[:])
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.bodies == nil {
+		c.bodies = make(map[string][]byte)
+	}
+	if _, ok := c.bodies[sha]; !ok && len(c.bodies) < ScriptCacheSize {
+		c.bodies[sha] = append([]byte{}, body...)
+	}
+}
+
+func (c *scriptCache) get(sha string) (body []byte, ok bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	body, ok = c.bodies[strings.ToLower(sha)]
+
+	return
+}
+
+// Caches the script of EVAL and SCRIPT LOAD, an EVALSHA of a cached script is
+// prepared to load it on NOSCRIPT. Called once the sub commands are built.
+func (s *Server) prepareScript(t *Task) {
+	if t.cmd == nil {
+		return
+	}
+
+	switch t.cmd.Name {
+	case "eval", "eval_ro":
+		if body, err := GetVal(t.arg(1)); err == nil {
+			s.scripts.add(body)
+		}
+	case "script":
+		if len(t.Raw) != 4 {
+			return
+		}
+		if sub, _ := GetVal(t.arg(1)); strings.EqualFold(string(sub), "load") {
+			if body, err := GetVal(t.arg(2)); err == nil {
+				s.scripts.add(body)
+			}
+		}
+	case "evalsha", "evalsha_ro":
+		sha, err := GetVal(t.arg(1))
+		if err != nil {
+			return
+		}
+		if body, ok := s.scripts.get(string(sha)); ok {
+			load := PackArray([][]byte{PackBulk([]byte("SCRIPT")), PackBulk([]byte("LOAD")), PackBulk(body)})
+			for _, info := range t.OutInfos {
+				info.retry = append(append([]byte{}, load...), info.data...)
+			}
+		}
+	}
+}
+
+// Loads the script and reruns the command once the backend replied NOSCRIPT,
+// the reply of SCRIPT LOAD is dropped.
+func (p *UnitPkg) reloadScript(ctx context.Context, proto int) error {
+	if p.retry == nil || !bytes.HasPrefix(p.data, NoScriptBytes) {
+		return nil
+	}
+	if err := p.conn.Write(p.retry); err != nil {
+		return err
+	}
+	p.retry, p.skip = nil, 1
+
+	return p.ReadReply(ctx, proto)
+}
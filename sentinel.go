@@ -0,0 +1,262 @@
+package minproxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+const SentinelRetryInterval = time.Second
+
+var (
+	ErrNoSentinels = errors.New("no sentinels err")
+	ErrNoMaster    = errors.New("no sentinel knows the master err")
+)
+
+// A "bucket_addr" entry of {"master_name":"mymaster"} is served by the master
+// the "sentinels":["host:26379"] of cfg know by that name. The proxy follows
+// their +switch-master events, so a failover moves its buckets to the new
+// master like a reload would.
+func sentinelsOf(cfg *util.Config) (addrs []string) {
+	for _, v := range cfg.GetArray("sentinels") {
+		if addr, ok := v.(string); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return
+}
+
+// Returns cfg with the addr of every "master_name" entry set to the master
+// the sentinels know, unless known has it already, and the addrs by master
+// name. cfg is returned as is if there is none. A sentinel is given up after
+// timeout.
+func resolveMasters(cfg *util.Config, known map[string]string, timeout time.Duration) (*util.Config, map[string]string, error) {
+	bucketAddrMap, _ := cfg.GetInterface("bucket_addr").(map[string]interface{})
+	resolved := make(map[string]interface{}, len(bucketAddrMap))
+	masters := make(map[string]string)
+	for b, v := range bucketAddrMap {
+		resolved[b] = v
+		entry, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := entry["master_name"].(string)
+		if name == "" {
+			continue
+		}
+		if _, ok := masters[name]; !ok {
+			addr, ok := known[name]
+			if !ok {
+				var err error
+				if addr, err = getMaster(sentinelsOf(cfg), name, timeout); err != nil {
+					return nil, nil, err
+				}
+			}
+			masters[name] = addr
+		}
+
+		e := make(map[string]interface{}, len(entry)+1)
+		for k, v := range entry {
+			e[k] = v
+		}
+		e["addr"] = masters[name]
+		resolved[b] = e
+	}
+	if len(masters) == 0 {
+		return cfg, nil, nil
+	}
+
+	cfg = cfg.Clone()
+	cfg.Set("bucket_addr", resolved)
+
+	return cfg, masters, nil
+}
+
+// Asks the sentinels in turn for the addr of the master named name.
+func getMaster(sentinels []string, name string, timeout time.Duration) (addr string, err error) {
+	if len(sentinels) == 0 {
+		return "", ErrNoSentinels
+	}
+	for _, sentinel := range sentinels {
+		if addr, err = getMasterOf(sentinel, name, timeout); err == nil {
+			return
+		}
+		log.Println("sentinel, addr:", sentinel, " master:", name, " err:", err)
+	}
+
+	return "", ErrNoMaster
+}
+
+// SENTINEL get-master-addr-by-name name
+func getMasterOf(sentinel, name string, timeout time.Duration) (string, error) {
+	c, err := util.NewCon(util.ConnType, sentinel, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(timeout))
+	if err = c.Write(PackCmd("SENTINEL", "get-master-addr-by-name", name)); err != nil {
+		return "", err
+	}
+	resp, err := ReadResp(c.R)
+	if err != nil {
+		return "", err
+	}
+	if resp.Null || len(resp.Elems) != 2 {
+		return "", ErrNoMaster
+	}
+
+	return net.JoinHostPort(string(resp.Elems[0].Val), string(resp.Elems[1].Val)), nil
+}
+
+// Subscribes to +switch-master on the sentinels of the running cfg, the
+// first one answering is followed until its conn fails. Every switch of a
+// master the cfg names applies the cfg again with the master switched to the
+// addr the message names. Once subscribed the masters are asked for, so a
+// switch missed meanwhile isn't lost. Returns once the server shuts down.
+func (s *Server) watchSentinels() {
+	for i := 0; !s.shuttingDown(); i++ {
+		s.bucketMux.RLock()
+		sentinels := sentinelsOf(s.cfg)
+		s.bucketMux.RUnlock()
+		if len(sentinels) == 0 {
+			time.Sleep(SentinelRetryInterval)
+			continue
+		}
+
+		sentinel := sentinels[i%len(sentinels)]
+		if err := s.followSentinel(sentinel); err != nil && !s.shuttingDown() {
+			log.Println("sentinel, addr:", sentinel, " err:", err)
+			time.Sleep(SentinelRetryInterval)
+		}
+	}
+}
+
+func (s *Server) followSentinel(sentinel string) error {
+	s.bucketMux.RLock()
+	timeout := s.timeouts.budget()
+	s.bucketMux.RUnlock()
+	c, err := util.NewCon(util.ConnType, sentinel, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = c.Write(PackCmd("SUBSCRIBE", "+switch-master")); err != nil {
+		return err
+	}
+	if err = s.syncMasters(sentinel, timeout); err != nil {
+		log.Println("sentinel, addr:", sentinel, " sync masters err:", err)
+	}
+
+	for !s.shuttingDown() {
+		//waiting with a deadline lets the shutdown be noticed, nothing is
+		//consumed until a message arrived
+		c.SetReadDeadline(time.Now().Add(SentinelRetryInterval))
+		if _, err := c.R.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		c.SetReadDeadline(time.Now().Add(timeout))
+		resp, err := ReadResp(c.R)
+		if err != nil {
+			return err
+		}
+		if len(resp.Elems) != 3 || string(resp.Elems[0].Val) != "message" {
+			continue
+		}
+
+		//"mymaster 127.0.0.1 6379 127.0.0.1 6380"
+		fields := strings.Fields(string(resp.Elems[2].Val))
+		if len(fields) != 5 || !s.followsMaster(fields[0]) {
+			continue
+		}
+		addr := net.JoinHostPort(fields[3], fields[4])
+		log.Println("sentinel, master:", fields[0], " switched to:", addr)
+		if err = s.failover(fields[0], addr); err != nil {
+			log.Println("sentinel, failover err:", err)
+		}
+	}
+
+	return nil
+}
+
+// Returns whether a "bucket_addr" entry of the running cfg is named name.
+func (s *Server) followsMaster(name string) bool {
+	s.bucketMux.RLock()
+	defer s.bucketMux.RUnlock()
+
+	bucketAddrMap, _ := s.cfg.GetInterface("bucket_addr").(map[string]interface{})
+	for _, v := range bucketAddrMap {
+		if entry, ok := v.(map[string]interface{}); ok && entry["master_name"] == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Asks sentinel for the masters of the running cfg and fails over to those
+// which moved.
+func (s *Server) syncMasters(sentinel string, timeout time.Duration) error {
+	s.bucketMux.RLock()
+	running := s.masters
+	s.bucketMux.RUnlock()
+
+	for name, addr := range running {
+		moved, err := getMasterOf(sentinel, name, timeout)
+		if err != nil {
+			return err
+		}
+		if moved == addr {
+			continue
+		}
+		log.Println("sentinel, master:", name, " moved to:", moved)
+		if err = s.failover(name, moved); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Applies the running cfg again with the master named name at addr, the other
+// masters stay where they are. A running migration is waited for, the cfg
+// can't be applied before it ends.
+func (s *Server) failover(name, addr string) error {
+	for !s.shuttingDown() {
+		s.bucketMux.RLock()
+		runs := s.migrationRuns()
+		s.bucketMux.RUnlock()
+		if !runs {
+			break
+		}
+		time.Sleep(SentinelRetryInterval)
+	}
+
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+
+	s.bucketMux.RLock()
+	cfg := s.cfg
+	known := map[string]string{name: addr}
+	for n, a := range s.masters {
+		if n != name {
+			known[n] = a
+		}
+	}
+	s.bucketMux.RUnlock()
+	conf, err := s.checkConfig(cfg, known)
+	if err != nil {
+		return err
+	}
+
+	return s.applyConfig(cfg, conf)
+}
@@ -2,87 +2,251 @@ package minproxy
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/zimulala/minproxy/util"
 )
 
+var ErrServerClosed = errors.New("server closed err")
+
+// Commands answered by the proxy itself, keyed by lowercase command name.
+var localCmds = map[string]func(*Server, *Task){
+	"ping":         (*Server).handlePing,
+	"echo":         (*Server).handleEcho,
+	"cluster":      (*Server).handleCluster,
+	"hello":        (*Server).handleHello,
+	"auth":         (*Server).handleAuth,
+	"proxy":        (*Server).handleProxy,
+	"subscribe":    (*Server).handleSubscribe,
+	"psubscribe":   (*Server).handlePsubscribe,
+	"unsubscribe":  (*Server).handleUnsubscribe,
+	"punsubscribe": (*Server).handlePunsubscribe,
+}
+
 type Server struct {
-	id       int
-	ip       string
-	port     string
-	connPool *util.ConnPool
+	id        int
+	ip        string
+	port      string
+	connPool  *util.ConnPool
+	blockPool *util.ConnPool //conns of blocking commands
+
+	startTime time.Time
+	clients   int64
+	cmds      int64
+	sessSeq   int64
+
+	cfg          *util.Config
+	reloadMux    sync.Mutex
+	router       Router
+	policy       *CmdPolicy
+	auth         *Auth
+	replicas     *Replicas
+	reads        sync.Map    //replica addr -> *int64, reads sent and not released yet
+	tls          *tls.Config //of the client listener, swapped on reload
+	timeouts     *Timeouts
+	scripts      scriptCache
+	migrations   map[int]*Migration //key: bucket
+	masters      map[string]string  //master name -> addr, of the running cfg
+	sentinelOnce sync.Once          //the sentinels are watched from the first cfg naming one
+	bucketMux    sync.RWMutex
 
-	bucketBase    int
-	buckets       []int
-	bucketAddrMap map[int]string //key: bucket, val: serverAddr
-	bucketMux     sync.RWMutex
+	listener   net.Listener
+	conns      map[net.Conn]Sigal
+	connWg     sync.WaitGroup
+	inShutdown bool
+	connMux    sync.Mutex
 }
 
 func NewServer() *Server {
 	return &Server{
-		connPool:      util.NewConnPool(),
-		bucketAddrMap: make(map[int]string)}
+		connPool:   util.NewConnPool(),
+		blockPool:  util.NewConnPool(),
+		migrations: make(map[int]*Migration),
+		conns:      make(map[net.Conn]Sigal)}
 }
 
 func (s *Server) Start(cfg *util.Config) error {
-	if err := s.CheckConfig(cfg); err != nil {
+	conf, err := s.CheckConfig(cfg)
+	if err != nil {
 		return err
 	}
-
-	if err := InitConnPool(s.bucketAddrMap, s.connPool); err != nil {
+	if err = s.applyConfig(cfg, conf); err != nil {
 		return err
 	}
+	s.id, s.ip, s.port = conf.id, conf.ip, conf.port
+	s.startTime = time.Now()
 
 	return s.ListenAndServe()
 }
 
+// Listens on the port of cfg, or on the unix socket at /path for a port of
+// "unix:/path".
 func (s *Server) ListenAndServe() (err error) {
-	l, err := net.Listen("tcp", ":"+s.port)
+	network, addr := util.SplitAddr("tcp", s.port)
+	if network == "tcp" {
+		addr = ":" + addr
+	} else {
+		removeStaleSocket(addr)
+	}
+	l, err := net.Listen(network, addr)
 	if err != nil {
 		return
 	}
+	if s.tlsConf() != nil {
+		l = tls.NewListener(l, &tls.Config{GetConfigForClient: s.clientTLS})
+	}
+	s.connMux.Lock()
+	if s.inShutdown {
+		s.connMux.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.connMux.Unlock()
+	defer l.Close()
 
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 		go s.Serve(c)
 	}
+}
+
+// Removes the socket file a proxy which didn't exit cleanly left at path. A
+// socket still accepting or anything else at path is kept, so Listen fails.
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+func (s *Server) shuttingDown() bool {
+	s.connMux.Lock()
+	defer s.connMux.Unlock()
+
+	return s.inShutdown
+}
+
+// Registers or unregisters a client conn, no conn is registered once the
+// shutdown began.
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.connMux.Lock()
+	defer s.connMux.Unlock()
+
+	if !add {
+		delete(s.conns, c)
+		s.connWg.Done()
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	s.conns[c] = Sigal{}
+	s.connWg.Add(1)
+
+	return true
+}
 
-	l.Close()
+// Shutdown stops accepting, stops reading new requests, waits until the
+// requests already read are answered and closes the backend conns. Client
+// conns still busy when ctx is done are closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.connMux.Lock()
+	s.inShutdown = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for c := range s.conns {
+		c.SetReadDeadline(time.Now())
+	}
+	s.connMux.Unlock()
+
+	doneCh := make(chan Sigal)
+	go func() {
+		s.connWg.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.connMux.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.connMux.Unlock()
+	}
+	s.connPool.Close()
+	s.blockPool.Close()
 
 	return
 }
 
+// Serve reads requests and queues them to handleReplys, which answers them in
+// order. Once reading stops every queued request is still answered before
+// the conn is closed.
 func (s *Server) Serve(c net.Conn) {
-	conn, _ := c.(*net.TCPConn)
-	conn.SetKeepAlive(true)
-	conn.SetNoDelay(true)
+	if !s.trackConn(c, true) {
+		c.Close()
+		return
+	}
+	defer s.trackConn(c, false)
+	atomic.AddInt64(&s.clients, 1)
+	defer atomic.AddInt64(&s.clients, -1)
+	if tcp, ok := util.TCPConn(c); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetNoDelay(true)
+	}
 	reader := bufio.NewReader(c)
+	sess := &Session{Id: atomic.AddInt64(&s.sessSeq, 1), Proto: Resp2, conn: c}
+	sess.ctx, sess.cancel = context.WithCancel(context.Background())
 	taskCh := make(chan *Task, 1024)
-	exitCh := make(chan Sigal, 1)
+	doneCh := make(chan Sigal)
 
-	go s.handleReplys(conn, taskCh, exitCh)
+	go s.handleReplys(sess, taskCh, doneCh)
 
 	for {
-		req, err := ReadReqs(conn, reader)
+		req, err := ReadReqs(c, reader)
 		if err != nil {
-			close(exitCh)
 			break
 		}
+		req.sess, req.Proto = sess, sess.Proto
+		sess.queue()
 		if err = s.handleReqs(req); err != nil {
-			close(exitCh)
+			sess.reply(nil)
 			break
 		}
 		taskCh <- req
 	}
-	conn.Close()
+	sess.cancel()
+	close(taskCh)
+	<-doneCh
+	sess.Close()
+	s.releaseTx(sess)
+	c.Close()
 }
 
-func ReadReqs(c *net.TCPConn, reader *bufio.Reader) (t *Task, err error) {
+func ReadReqs(c net.Conn, reader *bufio.Reader) (t *Task, err error) {
 	t = &Task{Id: GenerateId()}
 	if t.Raw, err = ReadReqData(reader); err != nil {
 		return
@@ -98,61 +262,145 @@ func (s *Server) handleReqs(req *Task) (err error) {
 	if err = req.UnmarshalPkg(); err != nil {
 		return
 	}
+	atomic.AddInt64(&s.cmds, 1)
+	req.ctx, req.cancel = s.requestContext(req)
+	if !s.authed(req) {
+		req.PackErrorReply(ErrNoAuth.Error())
+		return nil
+	}
+	if !req.IsErrTask() && !s.allowed(req) {
+		req.PackErrorReply(ErrNoSupport.Error())
+	}
+	if !req.IsErrTask() && !req.sess.allowed(req) {
+		req.PackErrorReply("ERR Can't execute '" + strings.ToLower(string(req.Cmd)) +
+			"': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context")
+	}
+	if req.IsErrTask() {
+		//a command refused while queueing aborts the transaction
+		req.sess.tx.aborted = req.sess.tx.aborted || req.sess.tx.multi
+		return nil
+	}
+	if req.sess.tx.multi || txCmds[strings.ToLower(string(req.Cmd))] {
+		s.handleTx(req)
+		return nil
+	}
+	if req.cmd != nil {
+		if handle, ok := localCmds[req.cmd.Name]; ok {
+			handle(s, req)
+			return nil
+		}
+	}
 
-	addrs, err := s.GetAddrs(req)
-	if err != nil {
+	var addrs []string
+	if req.cmd != nil && req.cmd.Is(CmdBroadcast) {
+		if addrs, err = s.broadcastAddrs(req); err != nil {
+			req.PackErrorReply(err.Error())
+			return nil
+		}
+	} else if len(req.OutInfos) == 0 {
+		req.PackErrorReply(ErrBadArgsNum.Error())
+		return nil
+	} else if addrs, err = s.GetAddrs(req); err != nil {
 		req.PackErrorReply(err.Error())
 		return nil
 	}
+	if req.isMulti() && !req.cmd.Is(CmdBroadcast) {
+		if addrs = req.groupByAddr(addrs); req.cmd.Merge == MergeSame && len(addrs) > 1 {
+			req.PackErrorReply(ErrCrossSlot.Error())
+			return nil
+		}
+	}
 
-	if err = s.GetConns(addrs, req); err != nil {
-		req.PackErrorReply(err.Error())
+	if req.cmd != nil && req.cmd.Is(CmdReadOnly) && !req.cmd.Is(CmdBroadcast) {
+		s.routeReads(req, addrs)
 	}
 
+	if req.cmd != nil && req.cmd.Is(CmdBlocking) {
+		if _, ok := req.blockTimeout(); ok {
+			for _, info := range req.OutInfos {
+				info.block = true
+			}
+		}
+	}
+
+	s.prepareScript(req)
+
+	//a failed UnitPkg keeps its err, which MergeReplys replies
+	s.GetConns(addrs, req)
+
 	return nil
 }
 
-func (s *Server) handleReplys(c *net.TCPConn, taskCh chan *Task, exitCh chan Sigal) {
-	for {
-		select {
-		case task := <-taskCh:
-			if task.IsErrTask() {
-				Write(c, *task.Resp)
-				s.ReleaseConns(task)
-				break
-			}
+// Checks the command against the deny, allow and broadcast lists of cfg.
+func (s *Server) allowed(t *Task) bool {
+	if t.Cmd == nil { //inline ping
+		return true
+	}
+	s.bucketMux.RLock()
+	p := s.policy
+	s.bucketMux.RUnlock()
 
-			ReadReplys(task)
-			if err := task.MergeReplys(); err != nil {
-				task.PackErrorReply(err.Error())
-			}
-			Write(c, *task.Resp)
+	return p.Allowed(strings.ToLower(string(t.Cmd)), t.cmd)
+}
+
+func (s *Server) handleReplys(sess *Session, taskCh chan *Task, doneCh chan Sigal) {
+	for task := range taskCh {
+		if task.IsErrTask() || task.IsLocalTask() {
+			sess.reply(*task.Resp)
 			s.ReleaseConns(task)
-		case <-exitCh:
-			return
+			task.done()
+			continue
 		}
-	}
 
-	return
+		ReadReplys(task)
+		s.readFallbacks(task)
+		if err := task.MergeReplys(); err != nil {
+			task.PackErrorReply(err.Error())
+		}
+		sess.reply(*task.Resp)
+		s.ReleaseConns(task)
+		task.done()
+	}
+	close(doneCh)
 }
 
 func ReadReplys(task *Task) {
 	if len(task.OutInfos) == 1 {
-		if err := task.OutInfos[0].ReadReply(); err != nil {
-			task.OutInfos[0].connAddr = task.OutInfos[0].conn.Addr()
+		if task.OutInfos[0].err == nil {
+			task.OutInfos[0].readReply(task.context(), task.Proto)
 		}
 		return
 	}
 
 	wg := sync.WaitGroup{}
 	for _, info := range task.OutInfos {
+		if info.err != nil {
+			continue
+		}
 		wg.Add(1)
-		go func() {
-			if err := info.ReadReply(); err != nil {
-				info.connAddr = info.conn.Addr()
-			}
+		go func(info *UnitPkg) {
+			info.readReply(task.context(), task.Proto)
 			wg.Done()
-		}()
+		}(info)
 	}
 	wg.Wait()
 }
+
+// On error the conn is closed and connAddr keeps its addr, so only the pool
+// slot is put back. A read given up as ctx is done fails with ErrReqTimeout
+// or ErrReqCanceled.
+func (p *UnitPkg) readReply(ctx context.Context, proto int) {
+	err := p.ReadReply(ctx, proto)
+	if err == nil {
+		err = p.reloadScript(ctx, proto)
+	}
+	if err == nil {
+		p.unwrapRead()
+	}
+	if err != nil {
+		p.connAddr, p.err = p.conn.Addr(), ctxErr(ctx, ErrReadConn)
+		p.conn.Close()
+		p.conn = nil
+	}
+	p.recordOutcome()
+}
@@ -1,9 +1,30 @@
 package minproxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
 	"math"
+	"math/big"
+	"net"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -174,3 +195,1802 @@ func TestBasic(t *testing.T) {
 		t.Log(tt.args[0].(string), " reply:", reply)
 	}
 }
+
+func newTask(args ...string) *Task {
+	raws, _ := ReadReqData(bufio.NewReader(bytes.NewReader(PackCmd(args...))))
+	return &Task{Raw: raws, sess: &Session{Proto: Resp2}}
+}
+
+func TestMKeys(t *testing.T) {
+	r := &BucketRouter{bucketBase: 1, buckets: []int{0, 1},
+		bucketAddrMap: map[int]string{0: "127.0.0.1:6379", 1: "127.0.0.1:6380"}}
+	srv := &Server{router: r, policy: &CmdPolicy{}}
+
+	//"a"(97) and "c"(99) go to bucket 1, "b"(98) to bucket 0
+	task := newTask("MGET", "a", "b", "c")
+	if err := task.UnmarshalPkg(); err != nil || len(task.OutInfos) != 3 {
+		t.Fatalf("unmarshal mget err:%v", err)
+	}
+	addrs, err := srv.GetAddrs(task)
+	if err != nil {
+		t.Fatalf("get addrs err:%v", err)
+	}
+	addrs = task.groupByAddr(addrs)
+	if len(addrs) != 2 || addrs[0] != "127.0.0.1:6380" || addrs[1] != "127.0.0.1:6379" {
+		t.Fatalf("group addrs:%v", addrs)
+	}
+	if string(task.OutInfos[0].data) != string(PackCmd("MGET", "a", "c")) {
+		t.Errorf("sub command:%q", task.OutInfos[0].data)
+	}
+	task.OutInfos[0].data = []byte("*2\r\n$2\r\nva\r\n$-1\r\n")
+	task.OutInfos[1].data = []byte("*1\r\n$2\r\nvb\r\n")
+	if err = task.MergeReplys(); err != nil || string(*task.Resp) != "*3\r\n$2\r\nva\r\n$2\r\nvb\r\n$-1\r\n" {
+		t.Errorf("merge mget:%q err:%v", *task.Resp, err)
+	}
+
+	//a failed backend only fails its keys
+	task.OutInfos[1].err = ErrReadConn
+	if err = task.MergeReplys(); err != nil || string(*task.Resp) != "*3\r\n$2\r\nva\r\n-read conn err\r\n$-1\r\n" {
+		t.Errorf("merge mget:%q err:%v", *task.Resp, err)
+	}
+
+	task = newTask("mset", "a", "1", "b", "2", "c", "3")
+	if err = task.UnmarshalPkg(); err != nil || len(task.OutInfos) != 3 {
+		t.Fatalf("unmarshal mset err:%v", err)
+	}
+	addrs, _ = srv.GetAddrs(task)
+	task.groupByAddr(addrs)
+	if string(task.OutInfos[0].data) != string(PackCmd("mset", "a", "1", "c", "3")) {
+		t.Errorf("sub command:%q", task.OutInfos[0].data)
+	}
+	task.OutInfos[0].data, task.OutInfos[1].data = PackStatus("OK"), PackStatus("OK")
+	if err = task.MergeReplys(); err != nil || string(*task.Resp) != "+OK\r\n" {
+		t.Errorf("merge mset:%q err:%v", *task.Resp, err)
+	}
+
+	task = newTask("DEL", "a", "b", "c")
+	task.UnmarshalPkg()
+	addrs, _ = srv.GetAddrs(task)
+	task.groupByAddr(addrs)
+	task.OutInfos[0].data, task.OutInfos[1].data = PackInt(2), PackInt(0)
+	if err = task.MergeReplys(); err != nil || string(*task.Resp) != ":2\r\n" {
+		t.Errorf("merge del:%q err:%v", *task.Resp, err)
+	}
+
+	task = newTask("MSETNX", "a", "1", "b", "2")
+	if err = srv.handleReqs(task); err != nil || string(*task.Resp) != "-"+ErrCrossSlot.Error()+"\r\n" {
+		t.Errorf("msetnx:%q err:%v", *task.Resp, err)
+	}
+
+	task = newTask("MSET", "a", "1", "b")
+	if err = task.UnmarshalPkg(); err != nil || string(*task.Resp) != "-ERR wrong number of arguments for 'mset' command\r\n" {
+		t.Errorf("unmarshal mset err:%v", err)
+	}
+
+	//HELP has no key, a subcommand missing its key is an arity err
+	for _, args := range [][]string{{"OBJECT", "HELP"}, {"xinfo", "help"}, {"XGROUP", "Help"}} {
+		task = newTask(args...)
+		if err = task.UnmarshalPkg(); err != nil || task.IsErrTask() || len(task.OutInfos) != 1 || len(task.OutInfos[0].key) != 0 {
+			t.Fatalf("unmarshal %v err:%v", args, err)
+		}
+		if addrs, err = srv.GetAddrs(task); err != nil || len(addrs) != 1 || string(task.OutInfos[0].data) != string(PackCmd(args...)) {
+			t.Errorf("%v addrs:%v err:%v", args, addrs, err)
+		}
+	}
+	for _, args := range [][]string{{"OBJECT", "ENCODING"}, {"XINFO", "STREAM"}, {"XGROUP", "CREATE"}} {
+		task = newTask(args...)
+		want := "-ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command\r\n"
+		if err = task.UnmarshalPkg(); err != nil || !task.IsErrTask() || string(*task.Resp) != want {
+			t.Errorf("unmarshal %v:%q err:%v", args, *task.Resp, err)
+		}
+	}
+}
+
+func TestCmdPolicy(t *testing.T) {
+	cfg := util.LoadConfigString(`{"deny_cmds":["DEL","object"],"broadcast_cmds":["dbsize"]}`)
+	p, err := NewCmdPolicy(cfg)
+	if err != nil {
+		t.Fatalf("new policy err:%v", err)
+	}
+	r := &BucketRouter{bucketBase: 1, buckets: []int{0, 1},
+		bucketAddrMap: map[int]string{0: "127.0.0.1:6379", 1: "127.0.0.1:6380"}}
+	srv := &Server{router: r, policy: p}
+
+	for _, args := range [][]string{{"del", "a"}, {"FLUSHDB"}, {"OBJECT", "HELP"}} {
+		task := newTask(args...)
+		if err = srv.handleReqs(task); err != nil || string(*task.Resp) != "-"+ErrNoSupport.Error()+"\r\n" {
+			t.Errorf("%v err:%v", args, err)
+		}
+	}
+
+	task := newTask("DBSIZE")
+	task.UnmarshalPkg()
+	if addrs, err := srv.broadcastAddrs(task); err != nil || len(addrs) != 2 || len(task.OutInfos) != 2 {
+		t.Fatalf("broadcast addrs:%v", addrs)
+	}
+	task.OutInfos[0].data, task.OutInfos[1].data = PackInt(3), PackInt(4)
+	if err = task.MergeReplys(); err != nil || string(*task.Resp) != ":7\r\n" {
+		t.Errorf("merge dbsize:%q err:%v", *task.Resp, err)
+	}
+
+	if _, err = NewCmdPolicy(util.LoadConfigString(`{"broadcast_cmds":["get"]}`)); err != ErrBadCmdsList {
+		t.Errorf("broadcast get err:%v", err)
+	}
+	p, _ = NewCmdPolicy(util.LoadConfigString(`{"allow_cmds":["get"]}`))
+	if !p.Allowed("get", LookupCmd([]byte("get"))) || p.Allowed("set", LookupCmd([]byte("set"))) {
+		t.Errorf("allow list")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	r := &BucketRouter{bucketBase: 1, buckets: []int{0, 1},
+		bucketAddrMap: map[int]string{0: "127.0.0.1:6379", 1: "127.0.0.1:6380"}}
+	srv := &Server{router: r, policy: &CmdPolicy{}}
+	route := func(task *Task) (err error) {
+		if err = task.UnmarshalPkg(); err == nil {
+			_, err = srv.broadcastAddrs(task)
+		}
+		return
+	}
+
+	task := newTask("KEYS", "*")
+	route(task)
+	task.OutInfos[0].data = []byte("*1\r\n$1\r\na\r\n")
+	task.OutInfos[1].data = []byte("*2\r\n$1\r\nb\r\n$1\r\nc\r\n")
+	if err := task.MergeReplys(); err != nil || string(*task.Resp) != "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n" {
+		t.Errorf("merge keys:%q err:%v", *task.Resp, err)
+	}
+
+	task = newTask("INFO")
+	route(task)
+	task.OutInfos[0].data = PackBulk([]byte("# Server\r\nredis_version:7.0.0\r\n\r\n# Keyspace\r\ndb0:keys=2,expires=1,avg_ttl=100\r\n"))
+	task.OutInfos[1].data = PackBulk([]byte("# Server\r\nredis_version:7.0.1\r\n\r\n# Keyspace\r\ndb0:keys=3,expires=1,avg_ttl=300\r\ndb1:keys=1,expires=0,avg_ttl=0\r\n"))
+	info := "# Server\r\nredis_version:7.0.0\r\n\r\n# Keyspace\r\ndb0:keys=5,expires=2,avg_ttl=200\r\ndb1:keys=1,expires=0,avg_ttl=0\r\n"
+	if err := task.MergeReplys(); err != nil || string(*task.Resp) != string(PackBulk([]byte(info))) {
+		t.Errorf("merge info:%q err:%v", *task.Resp, err)
+	}
+
+	//the first backend is done, the cursor moves to the second one
+	cursors := []struct {
+		in, sent, reply, out string
+	}{
+		{"0", "0", "0", "1"},
+		{"1", "0", "17", "17409"},
+		{"17409", "17", "0", "0"},
+	}
+	for _, c := range cursors {
+		task = newTask("SCAN", c.in, "COUNT", "10")
+		if err := route(task); err != nil {
+			t.Fatalf("scan %s err:%v", c.in, err)
+		}
+		if string(task.OutInfos[0].data) != string(PackCmd("SCAN", c.sent, "COUNT", "10")) {
+			t.Errorf("scan %s sent:%q", c.in, task.OutInfos[0].data)
+		}
+		task.OutInfos[0].data = PackArray([][]byte{PackBulk([]byte(c.reply)), PackArray(nil)})
+		if err := task.MergeReplys(); err != nil || string(*task.Resp) != string(PackArray([][]byte{PackBulk([]byte(c.out)), PackArray(nil)})) {
+			t.Errorf("scan %s merge:%q err:%v", c.in, *task.Resp, err)
+		}
+	}
+
+	task = newTask("SCAN", "2")
+	if err := route(task); err != ErrBadCursor {
+		t.Errorf("scan bad cursor err:%v", err)
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err:%v", err)
+	}
+	defer l.Close()
+	cmds := make(chan string, 4)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		r := bufio.NewReader(c)
+		for {
+			raws, err := ReadReqData(r)
+			if err != nil {
+				return
+			}
+			vals, _ := GetVals(raws[1:])
+			cmds <- string(bytes.Join(vals, []byte(" ")))
+			if string(vals[0]) == "SUBSCRIBE" {
+				c.Write(PackCmd("subscribe", "news", "1"))
+				c.Write(PackCmd("message", "news", "hi"))
+			}
+		}
+	}()
+
+	addr := l.Addr().String()
+	srv := &Server{router: &BucketRouter{bucketBase: 1, buckets: []int{0},
+		bucketAddrMap: map[int]string{0: addr}}, policy: &CmdPolicy{}, connPool: util.NewConnPool()}
+	client, proxy := net.Pipe()
+	defer client.Close()
+	sess := &Session{Proto: Resp2, conn: proxy}
+	run := func(args ...string) *Task {
+		task := newTask(args...)
+		task.sess, task.Proto = sess, sess.Proto
+		if err := srv.handleReqs(task); err != nil {
+			t.Fatalf("%v err:%v", args, err)
+		}
+		return task
+	}
+
+	task := run("SUBSCRIBE", "news")
+	if string(*task.Resp) != "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n" {
+		t.Errorf("subscribe reply:%q", *task.Resp)
+	}
+	if cmd := <-cmds; cmd != "SUBSCRIBE news" {
+		t.Errorf("backend got:%s", cmd)
+	}
+	//the confirmation of the backend is dropped, the message is pushed
+	msg, err := ReadRaw(bufio.NewReader(client), nil)
+	if err != nil || string(msg) != string(PackCmd("message", "news", "hi")) {
+		t.Errorf("message:%q err:%v", msg, err)
+	}
+
+	if task = run("GET", "a"); !task.IsErrTask() {
+		t.Errorf("get while subscribed:%q", *task.Resp)
+	}
+	if task = run("PING"); string(*task.Resp) != "*2\r\n$4\r\npong\r\n$0\r\n\r\n" {
+		t.Errorf("ping while subscribed:%q", *task.Resp)
+	}
+
+	task = run("UNSUBSCRIBE")
+	if string(*task.Resp) != "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:0\r\n" || sess.subscribed() {
+		t.Errorf("unsubscribe reply:%q", *task.Resp)
+	}
+	if len(sess.pubsub.conns) != 0 {
+		t.Errorf("dedicated conns left:%d", len(sess.pubsub.conns))
+	}
+
+	//a message pushed while a reply is owed waits for it
+	client2, proxy2 := net.Pipe()
+	defer client2.Close()
+	sess = &Session{Proto: Resp2, conn: proxy2}
+	readCh := make(chan string, 3)
+	go func() {
+		r := bufio.NewReader(client2)
+		for i := 0; i < 3; i++ {
+			raw, _ := ReadRaw(r, nil)
+			readCh <- string(raw)
+		}
+	}()
+	msg1, msg2 := PackCmd("message", "news", "1"), PackCmd("message", "news", "2")
+	confirm := PackCmd("subscribe", "news", "1")
+	sess.queue()
+	sess.push(msg1)
+	sess.reply(confirm)
+	sess.push(msg2)
+	for _, want := range [][]byte{confirm, msg1, msg2} {
+		if got := <-readCh; got != string(want) {
+			t.Errorf("pushed order got:%q want:%q", got, want)
+		}
+	}
+
+	//what a backend can't be dialed for isn't subscribed
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err:%v", err)
+	}
+	dead.Close()
+	live := fakeBackend(t, func([]string) []byte { return nil })
+	defer live.Close()
+	//"a"(97) goes to bucket 1, "b"(98) to bucket 0
+	srv.router = &BucketRouter{bucketBase: 1, buckets: []int{0, 1},
+		bucketAddrMap: map[int]string{0: live.Addr().String(), 1: dead.Addr().String()}}
+	sess = &Session{Proto: Resp2, conn: proxy2}
+	if task = run("SUBSCRIBE", "a", "b"); !task.IsErrTask() {
+		t.Errorf("subscribe to a dead backend:%q", *task.Resp)
+	}
+	for ch, addr := range sess.pubsub.channels {
+		if _, ok := sess.pubsub.conns[addr]; !ok {
+			t.Errorf("channel %s left on %s", ch, addr)
+		}
+	}
+	run("UNSUBSCRIBE")
+	if task = run("PSUBSCRIBE", "n*"); !task.IsErrTask() || sess.subscribed() || len(sess.pubsub.conns) != 0 {
+		t.Errorf("psubscribe to a dead backend:%q patterns:%v", *task.Resp, sess.pubsub.patterns)
+	}
+}
+
+// Starts a backend replying what reply returns for every command.
+func fakeBackend(t *testing.T, reply func(args []string) []byte) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err:%v", err)
+	}
+	serveFake(l, reply)
+
+	return l
+}
+
+func serveFake(l net.Listener, reply func(args []string) []byte) {
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				r := bufio.NewReader(c)
+				for {
+					raws, err := ReadReqData(r)
+					if err != nil {
+						c.Close()
+						return
+					}
+					vals, _ := GetVals(raws[1:])
+					args := make([]string, len(vals))
+					for i, v := range vals {
+						args[i] = string(v)
+					}
+					c.Write(reply(args))
+				}
+			}(c)
+		}
+	}()
+}
+
+func TestTx(t *testing.T) {
+	var backends []net.Listener
+	for i := 0; i < 2; i++ {
+		var queued [][]byte
+		l := fakeBackend(t, func(args []string) []byte {
+			switch args[0] {
+			case "MULTI", "WATCH", "UNWATCH", "DISCARD":
+				queued = nil
+				return PackStatus("OK")
+			case "EXEC":
+				elems := queued
+				queued = nil
+				return PackArray(elems)
+			case "PING":
+				queued = append(queued, PackStatus("PONG"))
+			case "ECHO":
+				queued = append(queued, PackBulk([]byte(args[1])))
+			default:
+				queued = append(queued, PackStatus("OK"))
+			}
+			return PackStatus("QUEUED")
+		})
+		defer l.Close()
+		backends = append(backends, l)
+	}
+
+	r := &BucketRouter{bucketBase: 1, buckets: []int{0, 1},
+		bucketAddrMap: map[int]string{0: backends[0].Addr().String(), 1: backends[1].Addr().String()}}
+	srv := &Server{router: r, policy: &CmdPolicy{}, connPool: util.NewConnPool()}
+	InitConnPool(r.Addrs(), srv.connPool)
+	sess := &Session{Proto: Resp2}
+	run := func(args ...string) string {
+		task := newTask(args...)
+		task.sess, task.Proto = sess, sess.Proto
+		if err := srv.handleReqs(task); err != nil {
+			t.Fatalf("%v err:%v", args, err)
+		}
+		if !task.IsErrTask() && !task.IsLocalTask() {
+			ReadReplys(task)
+			if err := task.MergeReplys(); err != nil {
+				task.PackErrorReply(err.Error())
+			}
+		}
+		srv.ReleaseConns(task)
+		return string(*task.Resp)
+	}
+
+	steps := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"EXEC"}, "-ERR EXEC without MULTI\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "a", "1"}, "+QUEUED\r\n"},
+		{[]string{"SET", "c", "1"}, "+QUEUED\r\n"},
+		{[]string{"SET", "b", "1"}, "-" + ErrCrossSlot.Error() + "\r\n"},
+		{[]string{"EXEC"}, "-" + ErrExecAbort.Error() + "\r\n"},
+		{[]string{"WATCH", "a"}, "+OK\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"MGET", "a", "c"}, "+QUEUED\r\n"},
+		{[]string{"SET", "c", "2"}, "+QUEUED\r\n"},
+		{[]string{"EXEC"}, "*2\r\n+OK\r\n+OK\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"KEYS", "*"}, "-" + ErrTxNoSupport.Error() + "\r\n"},
+		{[]string{"DISCARD"}, "+OK\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"PING"}, "+QUEUED\r\n"}, //sent once SET pins a conn
+		{[]string{"SET", "a", "1"}, "+QUEUED\r\n"},
+		{[]string{"ECHO", "hi"}, "+QUEUED\r\n"},
+		{[]string{"EXEC"}, "*3\r\n+PONG\r\n+OK\r\n$2\r\nhi\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"PING", "x"}, "+QUEUED\r\n"},
+		{[]string{"EXEC"}, "*1\r\n$1\r\nx\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"PING", "x", "y"}, "-ERR wrong number of arguments for 'ping' command\r\n"},
+		{[]string{"EXEC"}, "-" + ErrExecAbort.Error() + "\r\n"},
+		{[]string{"GET", "a"}, "+QUEUED\r\n"}, //the fake backend replies QUEUED to any other command
+	}
+	for _, step := range steps {
+		if reply := run(step.args...); reply != step.reply {
+			t.Errorf("%v reply:%q, want:%q", step.args, reply, step.reply)
+		}
+		if step.args[0] == "EXEC" && sess.tx.conn != nil {
+			t.Errorf("%v conn still pinned", step.args)
+		}
+	}
+	run("DISCARD")
+
+	//"a" and "c" are in bucket 1, "b" in bucket 0 of the same backend
+	r.bucketAddrMap[0] = r.bucketAddrMap[1]
+	steps = []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "a", "1"}, "+QUEUED\r\n"},
+		{[]string{"SET", "b", "1"}, "-" + ErrCrossSlot.Error() + "\r\n"},
+		{[]string{"DISCARD"}, "+OK\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "a", "1"}, "+QUEUED\r\n"},
+		{[]string{"close"}, ""},
+		{[]string{"SET", "c", "1"}, "-" + ErrWriteToConn.Error() + "\r\n"},
+		{[]string{"EXEC"}, "-" + ErrExecAbort.Error() + "\r\n"},
+	}
+	for _, step := range steps {
+		if step.args[0] == "close" { //the pinned conn fails
+			sess.tx.conn.Close()
+			continue
+		}
+		if reply := run(step.args...); reply != step.reply {
+			t.Errorf("%v reply:%q, want:%q", step.args, reply, step.reply)
+		}
+	}
+	for _, st := range srv.connPool.Stats() {
+		if sess.tx.conn != nil || st.Free != st.Size {
+			t.Errorf("pool %s free:%d size:%d pinned:%v", st.Addr, st.Free, st.Size, sess.tx.conn != nil)
+		}
+	}
+}
+
+func TestBlocking(t *testing.T) {
+	timeouts := []struct {
+		args []string
+		d    time.Duration
+		ok   bool
+	}{
+		{[]string{"BLPOP", "a", "b", "1.5"}, 1500 * time.Millisecond, true},
+		{[]string{"BLMOVE", "a", "b", "LEFT", "RIGHT", "0"}, 0, true},
+		{[]string{"XREAD", "COUNT", "1", "BLOCK", "200", "STREAMS", "a", "b", "0", "0"}, 200 * time.Millisecond, true},
+		{[]string{"XREAD", "STREAMS", "a", "0"}, 0, false},
+		{[]string{"BRPOP", "a", "x"}, 0, false},
+		{[]string{"BLMPOP", "2", "2", "a", "b", "LEFT"}, 2 * time.Second, true},
+		{[]string{"BZMPOP", "0", "1", "a", "MIN", "COUNT", "2"}, 0, true},
+	}
+	for _, c := range timeouts {
+		task := newTask(c.args...)
+		if err := task.UnmarshalPkg(); err != nil {
+			t.Fatalf("%v err:%v", c.args, err)
+		}
+		if d, ok := task.blockTimeout(); d != c.d || ok != c.ok {
+			t.Errorf("%v timeout:%v ok:%v", c.args, d, ok)
+		}
+	}
+	task := newTask("XREADGROUP", "GROUP", "g", "c", "STREAMS", "a", "b", ">", ">")
+	if task.UnmarshalPkg(); len(task.OutInfos) != 2 || string(task.OutInfos[1].rawKey) != "b" {
+		t.Errorf("xreadgroup keys:%d", len(task.OutInfos))
+	}
+
+	//a blocked command is cancelled once its client is gone
+	l := fakeBackend(t, func(args []string) []byte {
+		if args[0] == "BLPOP" {
+			select {}
+		}
+		return PackStatus("OK")
+	})
+	defer l.Close()
+	addr := l.Addr().String()
+	srv := &Server{router: &BucketRouter{bucketBase: 1, buckets: []int{0}, bucketAddrMap: map[int]string{0: addr}},
+		policy: &CmdPolicy{}, connPool: util.NewConnPool(), blockPool: util.NewConnPool()}
+	InitConnPool([]string{addr}, srv.connPool)
+	InitBlockPool([]string{addr}, srv.blockPool)
+
+	task = newTask("BLPOP", "a", "0")
+	task.sess.ctx, task.sess.cancel = context.WithCancel(context.Background())
+	if err := srv.handleReqs(task); err != nil || !task.OutInfos[0].block || task.OutInfos[0].err != nil {
+		t.Fatalf("blpop err:%v", err)
+	}
+	if st := srv.blockPool.Stats(); st[0].Free != BlockConnSize-1 {
+		t.Errorf("block pool free:%d", st[0].Free)
+	}
+	doneCh := make(chan Sigal)
+	go func() {
+		ReadReplys(task)
+		close(doneCh)
+	}()
+	task.sess.cancel()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatal("blpop not cancelled")
+	}
+	if task.OutInfos[0].err != ErrReqCanceled {
+		t.Errorf("blpop err:%v", task.OutInfos[0].err)
+	}
+	srv.ReleaseConns(task)
+	if st := srv.blockPool.Stats(); st[0].Free != BlockConnSize {
+		t.Errorf("block pool free:%d", st[0].Free)
+	}
+
+	//a full block pool fails the command and doesn't grow past its size
+	srv.blockPool = util.NewConnPool()
+	if _, err := srv.blockPool.NewBoundedUnitPool(1, addr, ConnTimeout, ConnRetrys); err != nil {
+		t.Fatalf("new block pool err:%v", err)
+	}
+	held := newTask("BLPOP", "a", "0")
+	held.sess.ctx, held.sess.cancel = context.WithCancel(context.Background())
+	srv.handleReqs(held)
+	for i := 0; i < 2; i++ {
+		task = newTask("BLPOP", "b", "0")
+		if err := srv.handleReqs(task); err != nil || task.OutInfos[0].err != ErrGetConn {
+			t.Errorf("blpop on full pool err:%v", task.OutInfos[0].err)
+		}
+		srv.ReleaseConns(task)
+		if st := srv.blockPool.Stats(); st[0].Free != 0 {
+			t.Errorf("full block pool free:%d", st[0].Free)
+		}
+	}
+	held.sess.cancel()
+	ReadReplys(held)
+	srv.ReleaseConns(held)
+	if st := srv.blockPool.Stats(); st[0].Free != 1 {
+		t.Errorf("block pool free:%d", st[0].Free)
+	}
+}
+
+func TestScript(t *testing.T) {
+	body := "return redis.call('get', KEYS[1])"
+	sum := sha1.Sum([]byte(body))
+	sha := hex.EncodeToString(sum[:])
+	loaded := false
+	l := fakeBackend(t, func(args []string) []byte {
+		switch {
+		case args[0] == "SCRIPT" && args[2] == body:
+			loaded = true
+			return PackBulk([]byte(sha))
+		case args[0] == "EVALSHA" && !loaded:
+			return []byte("-NOSCRIPT No matching script. Please use EVAL.\r\n")
+		}
+		return PackBulk([]byte("v"))
+	})
+	defer l.Close()
+
+	addr := l.Addr().String()
+	r := &BucketRouter{bucketBase: 1, buckets: []int{0, 1}, bucketAddrMap: map[int]string{0: addr, 1: "127.0.0.1:0"}}
+	srv := &Server{router: r, policy: &CmdPolicy{}, connPool: util.NewConnPool()}
+	InitConnPool([]string{addr}, srv.connPool)
+	run := func(args ...string) string {
+		task := newTask(args...)
+		if err := srv.handleReqs(task); err != nil {
+			t.Fatalf("%v err:%v", args, err)
+		}
+		if !task.IsErrTask() && !task.IsLocalTask() {
+			ReadReplys(task)
+			if err := task.MergeReplys(); err != nil {
+				task.PackErrorReply(err.Error())
+			}
+		}
+		srv.ReleaseConns(task)
+		return string(*task.Resp)
+	}
+
+	//"b" and "d" are routed to the backend, "a" isn't
+	if reply := run("EVAL", body, "2", "b", "d", "arg"); reply != "$1\r\nv\r\n" {
+		t.Errorf("eval reply:%q", reply)
+	}
+	if reply := run("EVALSHA", sha, "1", "b"); reply != "$1\r\nv\r\n" || !loaded {
+		t.Errorf("evalsha reply:%q loaded:%v", reply, loaded)
+	}
+	if reply := run("EVALSHA", sha, "2", "b", "a"); reply != "-"+ErrCrossSlot.Error()+"\r\n" {
+		t.Errorf("evalsha cross backend reply:%q", reply)
+	}
+	if reply := run("EVAL", body, "3", "b"); reply != "-ERR wrong number of arguments for 'eval' command\r\n" {
+		t.Errorf("eval numkeys reply:%q", reply)
+	}
+
+	task := newTask("EVAL", body, "0")
+	if task.UnmarshalPkg(); len(task.OutInfos) != 1 || len(task.OutInfos[0].key) != 0 {
+		t.Errorf("eval without keys:%d", len(task.OutInfos))
+	}
+}
+
+func TestAuth(t *testing.T) {
+	cfg := util.LoadConfigString(`{"requirepass":"secret","users":{"alice":"pw"},
+		"bucket_addr":{"0":{"addr":"127.0.0.1:6379","user":"proxy","password":"backend"}}}`)
+	a, err := NewAuth(cfg)
+	if err != nil {
+		t.Fatalf("new auth err:%v", err)
+	}
+	backends, err := backendsOf(cfg)
+	if err != nil || *backends["127.0.0.1:6379"].cred != (util.Credential{User: "proxy", Password: "backend"}) {
+		t.Errorf("backends:%v err:%v", backends, err)
+	}
+
+	l := fakeBackend(t, func(args []string) []byte {
+		switch {
+		case args[0] == "AUTH" && len(args) == 3 && args[1] == "proxy" && args[2] == "backend":
+			return PackStatus("OK")
+		case args[0] == "AUTH":
+			return []byte("-WRONGPASS invalid username-password pair\r\n")
+		}
+		return PackBulk([]byte("v"))
+	})
+	defer l.Close()
+
+	addr := l.Addr().String()
+	srv := &Server{router: &BucketRouter{bucketBase: 1, buckets: []int{0}, bucketAddrMap: map[int]string{0: addr}},
+		policy: &CmdPolicy{}, auth: a, connPool: util.NewConnPool()}
+	srv.connPool.SetCredential(addr, &util.Credential{User: "proxy", Password: "wrong"})
+	if err = InitConnPool([]string{addr}, srv.connPool); err != util.ErrAuth {
+		t.Errorf("init pool with a wrong password err:%v", err)
+	}
+	srv.connPool.SetCredential(addr, backends["127.0.0.1:6379"].cred)
+	if err = InitConnPool([]string{addr}, srv.connPool); err != nil {
+		t.Fatalf("init pool err:%v", err)
+	}
+
+	sess := &Session{Proto: Resp2}
+	run := func(args ...string) string {
+		task := newTask(args...)
+		task.sess = sess
+		if err := srv.handleReqs(task); err != nil {
+			t.Fatalf("%v err:%v", args, err)
+		}
+		if !task.IsErrTask() && !task.IsLocalTask() {
+			ReadReplys(task)
+			if err := task.MergeReplys(); err != nil {
+				task.PackErrorReply(err.Error())
+			}
+		}
+		srv.ReleaseConns(task)
+		return string(*task.Resp)
+	}
+
+	if reply := run("GET", "a"); reply != "-"+ErrNoAuth.Error()+"\r\n" {
+		t.Errorf("get before auth:%q", reply)
+	}
+	if reply := run("HELLO", "3"); reply != "-"+ErrHelloNoAuth.Error()+"\r\n" {
+		t.Errorf("hello before auth:%q", reply)
+	}
+	if reply := run("AUTH", "alice", "secret"); reply != "-"+ErrWrongPass.Error()+"\r\n" || sess.authed {
+		t.Errorf("auth with a wrong password:%q", reply)
+	}
+	if reply := run("AUTH", "secret"); reply != "+OK\r\n" || sess.user != DefaultUser {
+		t.Errorf("auth:%q user:%s", reply, sess.user)
+	}
+	if reply := run("GET", "a"); reply != "$1\r\nv\r\n" {
+		t.Errorf("get after auth:%q", reply)
+	}
+
+	sess = &Session{Proto: Resp2}
+	if reply := run("HELLO", "2", "AUTH", "alice", "pw"); !strings.HasPrefix(reply, "*14\r\n") || sess.user != "alice" {
+		t.Errorf("hello auth:%q user:%s", reply, sess.user)
+	}
+
+	srv.auth = &Auth{}
+	if reply := run("AUTH", "secret"); reply != "-"+ErrAuthNoPass.Error()+"\r\n" {
+		t.Errorf("auth without requirepass:%q", reply)
+	}
+}
+
+// testCA signs the certificates of the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ca key err:%v", err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "minproxy test ca"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("ca cert err:%v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, file: filepath.Join(dir, "ca.pem")}
+	writePem(t, ca.file, "CERTIFICATE", der)
+
+	return ca
+}
+
+// Issues a certificate for 127.0.0.1, returns its cert and key files.
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s key err:%v", name, err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("%s cert err:%v", name, err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	writePem(t, certFile, "CERTIFICATE", der)
+	writePem(t, keyFile, "EC PRIVATE KEY", keyDer)
+
+	return
+}
+
+func writePem(t *testing.T, file, typ string, der []byte) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatalf("write %s err:%v", file, err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	hang := make(chan Sigal)
+	defer close(hang)
+	l := fakeBackend(t, func(args []string) []byte {
+		if args[0] == "HELLO" && args[1] == "2" {
+			<-hang
+		}
+		return []byte("%1\r\n$5\r\nproto\r\n:3\r\n")
+	})
+	defer l.Close()
+	addr := l.Addr().String()
+	connP := util.NewConnPool()
+	InitConnPool([]string{addr}, connP)
+
+	//a deadline a pooled conn kept from an earlier request doesn't fail HELLO
+	c, err := connP.GetConn(addr)
+	if err != nil {
+		t.Fatalf("get conn err:%v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(-time.Second))
+	if err = negotiate(context.Background(), c, Resp3); err != nil || c.Proto != Resp3 {
+		t.Errorf("negotiate stale deadline proto:%d err:%v", c.Proto, err)
+	}
+
+	//a backend not answering HELLO fails it once the ctx deadline passes
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = negotiate(ctx, c, Resp2); err == nil || time.Since(start) > time.Second {
+		t.Errorf("negotiate hung backend err:%v after:%v", err, time.Since(start))
+	}
+	c.Close()
+	connP.PutConn(addr, nil)
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	srvCert, srvKey := ca.issue(t, dir, "server", 2)
+	cliCert, cliKey := ca.issue(t, dir, "client", 3)
+	tlsCfg := func(cert, key string) *util.Config {
+		return util.LoadConfigString(`{"tls_cert_file":"` + cert + `","tls_key_file":"` + key +
+			`","tls_ca_cert_file":"` + ca.file + `","tls_auth_clients":true,"backend_tls_ca_cert_file":"` + ca.file + `"}`)
+	}
+	conf, err := NewServerTLS(tlsCfg(srvCert, srvKey))
+	if err != nil {
+		t.Fatalf("server tls err:%v", err)
+	}
+
+	srv := NewServer()
+	srv.port, srv.policy, srv.tls = "0", &CmdPolicy{}, conf
+	go srv.ListenAndServe()
+	defer srv.Shutdown(context.Background())
+	var proxyAddr string
+	for i := 0; i < 100 && proxyAddr == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		srv.connMux.Lock()
+		if srv.listener != nil {
+			proxyAddr = "127.0.0.1:" + strconv.Itoa(srv.listener.Addr().(*net.TCPAddr).Port)
+		}
+		srv.connMux.Unlock()
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cert, err := tls.LoadX509KeyPair(cliCert, cliKey)
+	if err != nil {
+		t.Fatalf("client cert err:%v", err)
+	}
+	ping := func(certs []tls.Certificate) (*tls.Conn, error) {
+		c, err := tls.Dial("tcp", proxyAddr, &tls.Config{RootCAs: roots, Certificates: certs})
+		if err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write(PackCmd("PING"))
+		if reply, err := ReadRaw(bufio.NewReader(c), nil); err != nil || string(reply) != "+PONG\r\n" {
+			c.Close()
+			return nil, fmt.Errorf("ping reply:%q err:%v", reply, err)
+		}
+		return c, nil
+	}
+
+	c, err := ping([]tls.Certificate{cert})
+	if err != nil {
+		t.Fatalf("ping over tls err:%v", err)
+	}
+	c.Close()
+	if c, err = ping(nil); err == nil {
+		c.Close()
+		t.Errorf("ping without a client certificate passed")
+	}
+
+	//a reload serves the new certificate to new conns
+	newCert, newKey := ca.issue(t, dir, "server2", 4)
+	if conf, err = NewServerTLS(tlsCfg(newCert, newKey)); err != nil {
+		t.Fatalf("reload server tls err:%v", err)
+	}
+	srv.bucketMux.Lock()
+	srv.tls = conf
+	srv.bucketMux.Unlock()
+	if c, err = ping([]tls.Certificate{cert}); err != nil {
+		t.Fatalf("ping after reload err:%v", err)
+	}
+	if serial := c.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Errorf("served certificate serial:%d", serial)
+	}
+	c.Close()
+
+	//backends with "tls":true are dialed over TLS
+	bcert, err := tls.LoadX509KeyPair(srvCert, srvKey)
+	if err != nil {
+		t.Fatalf("backend cert err:%v", err)
+	}
+	bl, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{bcert}})
+	if err != nil {
+		t.Fatalf("backend listen err:%v", err)
+	}
+	defer bl.Close()
+	go func() {
+		for {
+			c, err := bl.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					if _, err := ReadReqData(r); err != nil {
+						return
+					}
+					c.Write(PackStatus("PONG"))
+				}
+			}(c)
+		}
+	}()
+
+	backendTLS, err := NewBackendTLS(tlsCfg(srvCert, srvKey))
+	if err != nil {
+		t.Fatalf("backend tls err:%v", err)
+	}
+	baddr := bl.Addr().String()
+	srv.connPool.SetTLSConfig(baddr, backendTLS)
+	if err = InitConnPool([]string{baddr}, srv.connPool); err != nil {
+		t.Fatalf("init tls pool err:%v", err)
+	}
+	bc, err := srv.connPool.GetConn(baddr)
+	if err != nil {
+		t.Fatalf("get tls conn err:%v", err)
+	}
+	defer srv.connPool.PutConn(baddr, bc)
+	bc.Write(PackCmd("PING"))
+	if reply, err := ReadRaw(bc.R, nil); err != nil || string(reply) != "+PONG\r\n" {
+		t.Errorf("backend ping reply:%q err:%v", reply, err)
+	}
+}
+
+func TestUnix(t *testing.T) {
+	dir := t.TempDir()
+	bl, err := net.Listen("unix", filepath.Join(dir, "backend.sock"))
+	if err != nil {
+		t.Fatalf("backend listen err:%v", err)
+	}
+	defer bl.Close()
+	serveFake(bl, func(args []string) []byte { return PackBulk([]byte("v")) })
+
+	//a socket file left by a proxy which didn't exit cleanly
+	proxyPath := filepath.Join(dir, "proxy.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: proxyPath, Net: "unix"})
+	if err != nil {
+		t.Fatalf("stale listen err:%v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	baddr := util.UnixPrefix + bl.Addr().String()
+	srv := NewServer()
+	srv.port, srv.policy = util.UnixPrefix+proxyPath, &CmdPolicy{}
+	srv.router = &BucketRouter{bucketBase: 1, buckets: []int{0}, bucketAddrMap: map[int]string{0: baddr}}
+	if err = InitConnPool([]string{baddr}, srv.connPool); err != nil {
+		t.Fatalf("init unix pool err:%v", err)
+	}
+	go srv.ListenAndServe()
+	defer srv.Shutdown(context.Background())
+
+	var c net.Conn
+	for i := 0; i < 100; i++ {
+		if c, err = net.Dial("unix", proxyPath); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial proxy err:%v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write(PackCmd("GET", "a"))
+	if reply, err := ReadRaw(bufio.NewReader(c), nil); err != nil || string(reply) != "$1\r\nv\r\n" {
+		t.Errorf("get over unix reply:%q err:%v", reply, err)
+	}
+	if addr := srv.addr(); addr != srv.port {
+		t.Errorf("proxy addr:%s", addr)
+	}
+}
+
+func TestBackendDown(t *testing.T) {
+	l := fakeBackend(t, func(args []string) []byte {
+		if args[0] == "PING" {
+			return []byte("-LOADING Redis is loading the dataset in memory\r\n")
+		}
+		return PackBulk([]byte("v"))
+	})
+	defer l.Close()
+
+	addr := l.Addr().String()
+	srv := &Server{router: &BucketRouter{bucketBase: 1, buckets: []int{0}, bucketAddrMap: map[int]string{0: addr}},
+		policy: &CmdPolicy{}, connPool: util.NewConnPool()}
+	if err := InitConnPool([]string{addr}, srv.connPool); err != nil {
+		t.Fatalf("init pool err:%v", err)
+	}
+	defer srv.connPool.Close()
+	p, _ := srv.connPool.GetUintPool(addr)
+	p.StartHealthCheck(util.HealthCheck{Interval: 10 * time.Millisecond, DownAfter: 1})
+	for i := 0; i < 200 && !p.Down(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	task := newTask("GET", "a")
+	srv.handleReqs(task)
+	ReadReplys(task)
+	if err := task.MergeReplys(); err != nil {
+		task.PackErrorReply(err.Error())
+	}
+	srv.ReleaseConns(task)
+	if string(*task.Resp) != "-"+ErrBackendDown.Error()+"\r\n" {
+		t.Errorf("get of a down backend:%q", *task.Resp)
+	}
+	if st := srv.connPool.Stats(); st[0].Free != st[0].Size {
+		t.Errorf("pool free:%d size:%d", st[0].Free, st[0].Size)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	var addrs []string
+	for _, name := range []string{"m", "r1", "r2"} {
+		name := name
+		l := fakeBackend(t, func(args []string) []byte { return PackBulk([]byte(name)) })
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+	cfg := util.LoadConfigString(`{"bucket_base":"1","buckets":[0],"bucket_addr":{"0":{"addr":"` + addrs[0] +
+		`","replicas":["` + addrs[1] + `","` + addrs[2] + `"]}}}`)
+	backends, err := backendsOf(cfg)
+	if err != nil || len(backends) != 3 {
+		t.Fatalf("backends:%v err:%v", backends, err)
+	}
+	r, err := NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("router err:%v", err)
+	}
+	replicas, err := NewReplicas(cfg, backends)
+	if err != nil {
+		t.Fatalf("replicas err:%v", err)
+	}
+
+	srv := &Server{router: r, replicas: replicas, policy: &CmdPolicy{}, connPool: util.NewConnPool()}
+	if err = InitConnPool(allAddrs(r, replicas), srv.connPool); err != nil {
+		t.Fatalf("init pools err:%v", err)
+	}
+	defer srv.connPool.Close()
+	run := func(args ...string) string {
+		task := newTask(args...)
+		srv.handleReqs(task)
+		ReadReplys(task)
+		if err := task.MergeReplys(); err != nil {
+			task.PackErrorReply(err.Error())
+		}
+		srv.ReleaseConns(task)
+		return string(*task.Resp)
+	}
+
+	got := map[string]int{}
+	for i := 0; i < 4; i++ {
+		got[run("GET", "a")]++
+	}
+	if got["$2\r\nr1\r\n"] != 2 || got["$2\r\nr2\r\n"] != 2 {
+		t.Errorf("round robin reads:%v", got)
+	}
+	if reply := run("SET", "a", "1"); reply != "$1\r\nm\r\n" {
+		t.Errorf("write went to:%q", reply)
+	}
+	//a message is published where its subscribers are
+	sub := newTask("SUBSCRIBE", "news")
+	if srv.handleReqs(sub); sub.sess.pubsub.channels["news"] != addrs[0] {
+		t.Errorf("subscribed on:%s", sub.sess.pubsub.channels["news"])
+	}
+	sub.sess.pubsub.Close()
+	for i := 0; i < 2; i++ {
+		if reply := run("PUBLISH", "news", "hi"); reply != "$1\r\nm\r\n" {
+			t.Errorf("publish went to:%q", reply)
+		}
+	}
+	if n := srv.outstanding(addrs[1]) + srv.outstanding(addrs[2]); n != 0 {
+		t.Errorf("outstanding reads after release:%d", n)
+	}
+
+	replicas.policy = ReadLeastOutstanding
+	srv.addOutstanding(addrs[1], 5)
+	for i := 0; i < 2; i++ {
+		if reply := run("GET", "a"); reply != "$2\r\nr2\r\n" {
+			t.Errorf("least outstanding read went to:%q", reply)
+		}
+	}
+
+	down := func(addr string) bool { return addr != addrs[0] }
+	if addr := replicas.pick(addrs[0], down, srv.outstanding); addr != "" {
+		t.Errorf("all replicas down, read went to:%s", addr)
+	}
+	replicas.policy = ReadMaster
+	if reply := run("GET", "a"); reply != "$1\r\nm\r\n" {
+		t.Errorf("master policy read went to:%q", reply)
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	var masters []string
+	for _, name := range []string{"m1", "m2"} {
+		name := name
+		l := fakeBackend(t, func(args []string) []byte { return PackBulk([]byte(name)) })
+		defer l.Close()
+		masters = append(masters, l.Addr().String())
+	}
+
+	//a sentinel knowing mymaster, a subscriber gets the conn pushed on subCh
+	var master atomic.Value
+	master.Store(masters[0])
+	subCh := make(chan net.Conn, 1)
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("sentinel listen err:%v", err)
+	}
+	defer sl.Close()
+	go func() {
+		for {
+			c, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				r := bufio.NewReader(c)
+				for {
+					raws, err := ReadReqData(r)
+					if err != nil {
+						c.Close()
+						return
+					}
+					vals, _ := GetVals(raws[1:])
+					switch string(vals[0]) {
+					case "SENTINEL":
+						host, port, _ := net.SplitHostPort(master.Load().(string))
+						c.Write(PackCmd(host, port))
+					case "SUBSCRIBE":
+						c.Write(PackArray([][]byte{PackBulk([]byte("subscribe")), PackBulk(vals[1]), []byte(":1\r\n")}))
+						subCh <- c
+					}
+				}
+			}(c)
+		}
+	}()
+
+	cfg := util.LoadConfigString(`{"id":"1","ip":"127.0.0.1","port":"0","bucket_base":"1","buckets":[0],
+		"sentinels":["` + sl.Addr().String() + `"],"bucket_addr":{"0":{"master_name":"mymaster"}}}`)
+	srv := NewServer()
+	conf, err := srv.CheckConfig(cfg)
+	if err != nil {
+		t.Fatalf("check config err:%v", err)
+	}
+	if err = srv.applyConfig(cfg, conf); err != nil {
+		t.Fatalf("apply config err:%v", err)
+	}
+	defer srv.Shutdown(context.Background())
+	run := func() string {
+		task := newTask("GET", "a")
+		srv.handleReqs(task)
+		ReadReplys(task)
+		if err := task.MergeReplys(); err != nil {
+			task.PackErrorReply(err.Error())
+		}
+		srv.ReleaseConns(task)
+		return string(*task.Resp)
+	}
+	if reply := run(); reply != "$2\r\nm1\r\n" {
+		t.Errorf("get before failover:%q", reply)
+	}
+
+	var sub net.Conn
+	select {
+	case sub = <-subCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the proxy didn't subscribe to the sentinel")
+	}
+	//the addr of the message is applied, the sentinel isn't asked again
+	host, port, _ := net.SplitHostPort(masters[0])
+	newHost, newPort, _ := net.SplitHostPort(masters[1])
+	sub.Write(PackCmd("message", "+switch-master", strings.Join([]string{"mymaster", host, port, newHost, newPort}, " ")))
+
+	reply := ""
+	for i := 0; i < 200 && reply != "$2\r\nm2\r\n"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		reply = run()
+	}
+	if reply != "$2\r\nm2\r\n" {
+		t.Errorf("get after failover:%q", reply)
+	}
+	if _, ok := srv.connPool.GetUintPool(masters[1]); !ok {
+		t.Errorf("no pool of the new master")
+	}
+
+	//a switch missed while the conn was down is caught up with once subscribed again
+	sub.Close()
+	select {
+	case <-subCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the proxy didn't subscribe to the sentinel again")
+	}
+	for i := 0; i < 200 && reply != "$2\r\nm1\r\n"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		reply = run()
+	}
+	if reply != "$2\r\nm1\r\n" {
+		t.Errorf("get after resubscribing:%q", reply)
+	}
+
+	//a sentinel not answering is given up once the request budget passes
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err:%v", err)
+	}
+	defer silent.Close()
+	cfg = util.LoadConfigString(`{"sentinels":["` + silent.Addr().String() + `"],
+		"bucket_addr":{"0":{"master_name":"mymaster"}}}`)
+	start := time.Now()
+	if _, _, err = resolveMasters(cfg, nil, 100*time.Millisecond); err != ErrNoMaster || time.Since(start) > time.Second {
+		t.Errorf("silent sentinel err:%v after:%v", err, time.Since(start))
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	l := fakeBackend(t, func(args []string) []byte { return PackBulk([]byte("v")) })
+	defer l.Close()
+
+	addr := l.Addr().String()
+	srv := &Server{router: &BucketRouter{bucketBase: 1, buckets: []int{0}, bucketAddrMap: map[int]string{0: addr}},
+		policy: &CmdPolicy{}, connPool: util.NewConnPool()}
+	cfg := util.LoadConfigString(`{"breaker_error_rate":"100","breaker_min_requests":"1"}`)
+	conf, err := NewBreakerConf(cfg)
+	if err != nil {
+		t.Fatalf("breaker conf err:%v", err)
+	}
+	conf.SlowLatency = time.Nanosecond //every request is slow
+	srv.connPool.SetBreaker(conf)
+	if err = InitConnPool([]string{addr}, srv.connPool); err != nil {
+		t.Fatalf("init pool err:%v", err)
+	}
+	defer srv.connPool.Close()
+	run := func() string {
+		task := newTask("GET", "a")
+		srv.handleReqs(task)
+		ReadReplys(task)
+		if err := task.MergeReplys(); err != nil {
+			task.PackErrorReply(err.Error())
+		}
+		srv.ReleaseConns(task)
+		return string(*task.Resp)
+	}
+
+	//the outcome is recorded once the reply is read, the client write isn't timed
+	task := newTask("GET", "a")
+	srv.handleReqs(task)
+	if ReadReplys(task); string(task.OutInfos[0].data) != "$1\r\nv\r\n" || srv.connPool.Stats()[0].Breaker != "open" {
+		t.Errorf("get with the breaker closed:%q breaker:%s", task.OutInfos[0].data, srv.connPool.Stats()[0].Breaker)
+	}
+	srv.ReleaseConns(task)
+	if reply := run(); reply != "-"+ErrBreakerOpen.Error()+"\r\n" {
+		t.Errorf("get with the breaker open:%q", reply)
+	}
+	if st := srv.connPool.Stats(); st[0].Breaker != "open" || st[0].Free != st[0].Size {
+		t.Errorf("pool stats:%+v", st[0])
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	cfg := util.LoadConfigString(`{"request_timeout":"100","command_timeouts":{"KEYS":"2000"}}`)
+	timeouts, err := NewTimeouts(cfg)
+	if err != nil {
+		t.Fatalf("timeouts err:%v", err)
+	}
+	for _, c := range []struct {
+		args []string
+		d    time.Duration
+	}{
+		{[]string{"GET", "a"}, 100 * time.Millisecond},
+		{[]string{"KEYS", "*"}, 2 * time.Second},
+	} {
+		task := newTask(c.args...)
+		task.UnmarshalPkg()
+		if d := timeouts.of(task); d != c.d {
+			t.Errorf("%v timeout:%v", c.args, d)
+		}
+	}
+	//JSON numbers are taken as well
+	timeouts, err = NewTimeouts(util.LoadConfigString(`{"request_timeout":300,"command_timeouts":{"keys":1500}}`))
+	if task := newTask("KEYS", "*"); err != nil || timeouts.budget() != 300*time.Millisecond ||
+		task.UnmarshalPkg() != nil || timeouts.of(task) != 1500*time.Millisecond {
+		t.Errorf("numeric timeouts:%+v err:%v", timeouts, err)
+	}
+	for _, bad := range []string{`{"request_timeout":"0"}`, `{"command_timeouts":{"nosuchcmd":"10"}}`,
+		`{"command_timeouts":{"get":"x"}}`, `{"command_timeouts":["get"]}`, `{"request_timeout":0}`,
+		`{"request_timeout":"x"}`, `{"command_timeouts":{"get":1.5}}`} {
+		if _, err := NewTimeouts(util.LoadConfigString(bad)); err == nil {
+			t.Errorf("%s no err", bad)
+		}
+	}
+
+	//a backend slower than the budget fails the request, its slot is put back
+	l := fakeBackend(t, func(args []string) []byte {
+		if args[0] == "GET" || args[0] == "MIGRATE" {
+			time.Sleep(time.Second)
+		}
+		return PackStatus("OK")
+	})
+	defer l.Close()
+	addr := l.Addr().String()
+	srv := &Server{router: &BucketRouter{bucketBase: 1, buckets: []int{0}, bucketAddrMap: map[int]string{0: addr}},
+		policy: &CmdPolicy{}, connPool: util.NewConnPool(), timeouts: timeouts}
+	if err = InitConnPool([]string{addr}, srv.connPool); err != nil {
+		t.Fatalf("init pool err:%v", err)
+	}
+	defer srv.connPool.Close()
+
+	task := newTask("GET", "a")
+	start := time.Now()
+	if err = srv.handleReqs(task); err != nil || task.OutInfos[0].err != nil {
+		t.Fatalf("get err:%v", err)
+	}
+	ReadReplys(task)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("get took:%v", d)
+	}
+	if task.OutInfos[0].err != ErrReqTimeout {
+		t.Errorf("get err:%v", task.OutInfos[0].err)
+	}
+	srv.ReleaseConns(task)
+	task.done()
+	if st := srv.connPool.Stats(); st[0].Free != st[0].Size {
+		t.Errorf("pool free:%d size:%d", st[0].Free, st[0].Size)
+	}
+
+	//a request whose ctx is done already takes no conn
+	task = newTask("SET", "a", "b")
+	task.UnmarshalPkg()
+	task.ctx, task.cancel = context.WithCancel(context.Background())
+	task.cancel()
+	addrs, _ := srv.GetAddrs(task)
+	srv.GetConns(addrs, task)
+	if task.OutInfos[0].err != ErrReqCanceled || task.OutInfos[0].connAddr != "" {
+		t.Errorf("set err:%v addr:%q", task.OutInfos[0].err, task.OutInfos[0].connAddr)
+	}
+	srv.ReleaseConns(task)
+	if st := srv.connPool.Stats(); st[0].Free != st[0].Size {
+		t.Errorf("pool free:%d size:%d", st[0].Free, st[0].Size)
+	}
+
+	//a key moved for a request gets no longer than the request
+	m := &Migration{Bucket: 0, From: addr, To: "127.0.0.1:1"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err = m.moveKey(ctx, srv, []byte("a")); err != ErrReqTimeout || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("move key err:%v after:%v", err, time.Since(start))
+	}
+	if st := srv.connPool.Stats(); st[0].Free != st[0].Size {
+		t.Errorf("pool free:%d size:%d", st[0].Free, st[0].Size)
+	}
+}
+
+// fakeStore is a backend holding keys, SCAN returns them all at once and
+// MIGRATE removes the keys it names.
+type fakeStore struct {
+	mu       sync.Mutex
+	keys     map[string]bool
+	migrated []string   //the MIGRATE commands received
+	scanCh   chan Sigal //SCAN waits for it to be closed unless it is nil
+	queued   [][]string //commands queued by MULTI, nil outside of it
+}
+
+func (st *fakeStore) reply(args []string) []byte {
+	st.mu.Lock()
+	switch {
+	case args[0] == "MULTI":
+		st.queued = [][]string{}
+		st.mu.Unlock()
+		return PackStatus("OK")
+	case args[0] == "EXEC":
+		queued := st.queued
+		st.queued = nil
+		st.mu.Unlock()
+		elems := make([][]byte, len(queued))
+		for i, q := range queued {
+			elems[i] = st.reply(q)
+		}
+		return PackArray(elems)
+	case st.queued != nil:
+		st.queued = append(st.queued, args)
+		st.mu.Unlock()
+		return PackStatus("QUEUED")
+	}
+	st.mu.Unlock()
+
+	switch args[0] {
+	case "EXISTS", "GET":
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		switch {
+		case args[0] == "EXISTS" && st.keys[args[1]]:
+			return PackInt(1)
+		case args[0] == "EXISTS":
+			return PackInt(0)
+		case st.keys[args[1]]:
+			return PackBulk([]byte("s"))
+		}
+		return []byte("$-1\r\n")
+	case "SCAN":
+		if st.scanCh != nil {
+			<-st.scanCh
+		}
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		var keys [][]byte
+		for k := range st.keys {
+			keys = append(keys, PackBulk([]byte(k)))
+		}
+		return PackArray([][]byte{PackBulk([]byte("0")), PackArray(keys)})
+	case "MIGRATE":
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.migrated = append(st.migrated, strings.Join(args, " "))
+		delete(st.keys, args[3])
+		for i := len(args) - 1; i > 0 && args[i] != "KEYS"; i-- {
+			delete(st.keys, args[i])
+		}
+	}
+	return PackStatus("OK")
+}
+
+func TestMigrate(t *testing.T) {
+	src := &fakeStore{keys: map[string]bool{"a": true, "b": true, "c": true}, scanCh: make(chan Sigal)}
+	ls := fakeBackend(t, src.reply)
+	defer ls.Close()
+	ld := fakeBackend(t, func(args []string) []byte {
+		if args[0] == "GET" {
+			return PackBulk([]byte("t"))
+		}
+		return PackStatus("OK")
+	})
+	defer ld.Close()
+	from, to := ls.Addr().String(), ld.Addr().String()
+	_, port := splitAddr(to)
+
+	//"a"(97) and "c"(99) are of bucket 1, "b"(98) of bucket 0
+	r := &BucketRouter{bucketBase: 1, buckets: []int{0, 1}, bucketAddrMap: map[int]string{0: from, 1: from}}
+	srv := NewServer()
+	srv.router, srv.policy = r, &CmdPolicy{}
+	if err := InitConnPool([]string{from}, srv.connPool); err != nil {
+		t.Fatalf("init pool err:%v", err)
+	}
+	defer srv.connPool.Close()
+
+	if _, err := srv.MigrateBucket(1, from); err != util.ErrSameAddr {
+		t.Errorf("migrate to the same addr err:%v", err)
+	}
+	if _, err := srv.MigrateBucket(2, to); err != ErrBadBucketKey {
+		t.Errorf("migrate an unknown bucket err:%v", err)
+	}
+	if _, err := srv.MigrateBucket(1, util.UnixPrefix+"/tmp/redis.sock"); err != ErrMigrateToUnix {
+		t.Errorf("migrate to a unix socket err:%v", err)
+	}
+	//the source logs in to the target with the credential of the target
+	srv.connPool.SetCredential(to, &util.Credential{User: "proxy", Password: "pw"})
+	m, err := srv.MigrateBucket(1, to)
+	if err != nil {
+		t.Fatalf("migrate err:%v", err)
+	}
+	if _, err = srv.MigrateBucket(1, to); err != ErrBucketMigrating {
+		t.Errorf("migrate a migrating bucket err:%v", err)
+	}
+
+	//while the scan waits, a write moves its key first, a read of the bucket is
+	//double routed; neither goes to a replica
+	srv.replicas = &Replicas{policy: ReadRoundRobin, groups: map[string][]string{from: {"127.0.0.1:1"}, to: {"127.0.0.1:1"}},
+		next: map[string]*uint32{from: new(uint32), to: new(uint32)}}
+	for _, c := range []struct {
+		args     []string
+		addr     string
+		fallback string
+	}{
+		{[]string{"SET", "a", "1"}, to, ""},
+		{[]string{"GET", "c"}, from, to},
+		{[]string{"GET", "b"}, "127.0.0.1:1", ""},
+	} {
+		task := newTask(c.args...)
+		task.UnmarshalPkg()
+		addrs, err := srv.GetAddrs(task)
+		if err == nil && task.cmd.Is(CmdReadOnly) {
+			srv.routeReads(task, addrs)
+		}
+		if err != nil || addrs[0] != c.addr || task.OutInfos[0].fallback != c.fallback {
+			t.Errorf("%v routed to:%v fallback:%s err:%v", c.args, addrs, task.OutInfos[0].fallback, err)
+		}
+	}
+	srv.replicas = nil
+	run := func(args ...string) string {
+		task := newTask(args...)
+		if err := srv.handleReqs(task); err != nil {
+			t.Fatalf("%v err:%v", args, err)
+		}
+		ReadReplys(task)
+		srv.readFallbacks(task)
+		if err := task.MergeReplys(); err != nil {
+			task.PackErrorReply(err.Error())
+		}
+		srv.ReleaseConns(task)
+		return string(*task.Resp)
+	}
+	//"c" is still on the source, "a" was moved to the target
+	if reply := run("GET", "c"); reply != "$1\r\ns\r\n" {
+		t.Errorf("get c:%q", reply)
+	}
+	if reply := run("GET", "a"); reply != "$1\r\nt\r\n" {
+		t.Errorf("get a:%q", reply)
+	}
+	close(src.scanCh)
+	for i := 0; i < 200 && m.State() == MigrateRunning; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	srv.bucketMux.RLock()
+	addr := r.bucketAddrMap[1]
+	srv.bucketMux.RUnlock()
+	if m.State() != MigrateDone || addr != to || atomic.LoadInt64(&m.moved) != 1 {
+		t.Errorf("migration:%v bucket 1 at:%s", m, addr)
+	}
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	want := []string{"MIGRATE 127.0.0.1 " + strconv.Itoa(port) + " a 0 5000 REPLACE AUTH2 proxy pw",
+		"MIGRATE 127.0.0.1 " + strconv.Itoa(port) + "  0 5000 REPLACE AUTH2 proxy pw KEYS c"}
+	if strings.Join(src.migrated, "|") != strings.Join(want, "|") || len(src.keys) != 1 || !src.keys["b"] {
+		t.Errorf("migrated:%q keys left:%v", src.migrated, src.keys)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	src := &fakeStore{keys: map[string]bool{"a": true}}
+	ls := fakeBackend(t, src.reply)
+	defer ls.Close()
+	ld := fakeBackend(t, func([]string) []byte { return PackStatus("OK") })
+	defer ld.Close()
+	from, to := ls.Addr().String(), ld.Addr().String()
+
+	cfg := util.LoadConfigString(`{"id":"1","ip":"127.0.0.1","port":"0","bucket_base":"1","buckets":[0,1],` +
+		`"bucket_addr":{"0":"` + from + `","1":"` + from + `"}}`)
+	srv := NewServer()
+	conf, err := srv.CheckConfig(cfg)
+	if err == nil {
+		err = srv.applyConfig(cfg, conf)
+	}
+	if err != nil {
+		t.Fatalf("apply config err:%v", err)
+	}
+	defer srv.connPool.Close()
+	defer srv.blockPool.Close()
+	run := func(args ...string) string {
+		task := newTask(args...)
+		srv.handleReqs(task)
+		return string(*task.Resp)
+	}
+
+	if reply := run("PROXY", "INFO"); !strings.Contains(reply, "router:bucket\r\n") || !strings.Contains(reply, "backends:1\r\n") {
+		t.Errorf("proxy info:%q", reply)
+	}
+	if reply := run("PROXY", "POOLS"); !strings.Contains(reply, from+" size:600 free_slots:600 down:false breaker:off") {
+		t.Errorf("proxy pools:%q", reply)
+	}
+	for _, c := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PROXY", "BUCKETS"}, string(packLines([]string{"0 " + from, "1 " + from}))},
+		{[]string{"PROXY", "CONFIG", "GET", "bucket_b*"}, "*2\r\n$11\r\nbucket_base\r\n$1\r\n1\r\n"},
+		{[]string{"PROXY", "CONFIG", "SET", "port", "1"}, "-ERR config key port is read only\r\n"},
+		{[]string{"PROXY", "CONFIG", "SET", "read_policy", "nope"}, "-ERR " + ErrBadReadPolicy.Error() + "\r\n"},
+		{[]string{"PROXY", "CONFIG", "SET", "read_policy", "master"}, "+OK\r\n"},
+		{[]string{"PROXY", "CONFIG", "GET", "read_policy"}, "*2\r\n$11\r\nread_policy\r\n$6\r\nmaster\r\n"},
+		{[]string{"PROXY", "RELOAD"}, "-ERR " + ErrNoCfgFile.Error() + "\r\n"},
+		{[]string{"PROXY", "NOPE"}, "-ERR unknown subcommand or wrong number of arguments for 'nope'\r\n"},
+		{[]string{"PROXY", "MIGRATE", "x", to}, "-ERR bad bucket\r\n"},
+		{[]string{"PROXY", "MIGRATE", "7", to}, "-ERR " + ErrBadBucketKey.Error() + "\r\n"},
+		{[]string{"PROXY", "MIGRATE", "1", from}, "-ERR " + util.ErrSameAddr.Error() + "\r\n"},
+		{[]string{"PROXY", "MIGRATIONS"}, "*0\r\n"},
+	} {
+		if reply := run(c.args...); reply != c.reply {
+			t.Errorf("%v:%q", c.args, reply)
+		}
+	}
+
+	//a migrated bucket stays where it was moved to when the cfg is applied again
+	if reply := run("PROXY", "MIGRATE", "1", to); !strings.HasPrefix(reply, "$") || !strings.Contains(reply, "bucket:1 from:"+from+" to:"+to) {
+		t.Fatalf("proxy migrate:%q", reply)
+	}
+	for i := 0; i < 200 && strings.Contains(run("PROXY", "MIGRATIONS"), "state:running"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reply := run("PROXY", "MIGRATIONS"); !strings.Contains(reply, "bucket:1 from:"+from+" to:"+to+" state:done") {
+		t.Errorf("proxy migrations:%q", reply)
+	}
+	if reply := run("PROXY", "CONFIG", "SET", "read_policy", "round_robin"); reply != "+OK\r\n" {
+		t.Errorf("config set after migration:%q", reply)
+	}
+	if reply := run("PROXY", "BUCKETS"); reply != string(packLines([]string{"0 " + from, "1 " + to})) {
+		t.Errorf("buckets after migration:%q", reply)
+	}
+
+	//passwords aren't shown and only the default user may change them
+	denied := "-ERR config key requirepass can only be set by the default user authenticated with requirepass\r\n"
+	if reply := run("PROXY", "CONFIG", "SET", "requirepass", "x"); reply != denied {
+		t.Errorf("config set requirepass without auth:%q", reply)
+	}
+	srv.bucketMux.Lock()
+	srv.cfg = util.LoadConfigString(`{"requirepass":"secret","users":{"alice":"pw"},` +
+		`"bucket_addr":{"0":{"addr":"` + from + `","user":"proxy","password":"bpw"}}}`)
+	srv.auth = &Auth{users: map[string]string{DefaultUser: "secret", "alice": "pw"}}
+	srv.bucketMux.Unlock()
+	runAs := func(user string, args ...string) string {
+		task := newTask(args...)
+		task.sess.user, task.sess.authed = user, true
+		srv.handleReqs(task)
+		return string(*task.Resp)
+	}
+	reply := runAs(DefaultUser, "PROXY", "CONFIG", "GET", "*")
+	if strings.Contains(reply, "secret") || strings.Contains(reply, "pw\r") || strings.Contains(reply, "bpw") ||
+		!strings.Contains(reply, `{"alice":"******"}`) || !strings.Contains(reply, `"password":"******"`) || !strings.Contains(reply, `"user":"proxy"`) {
+		t.Errorf("config get with passwords:%q", reply)
+	}
+	for _, user := range []string{"alice", ""} {
+		if reply := runAs(user, "PROXY", "CONFIG", "SET", "users", `{"bob":"x"}`); reply != strings.Replace(denied, "requirepass can", "users can", 1) {
+			t.Errorf("config set users as %q:%q", user, reply)
+		}
+	}
+	if !srv.isAdmin(&Task{sess: &Session{user: DefaultUser, authed: true}}) {
+		t.Errorf("default user isn't admin")
+	}
+}
+
+func TestReload(t *testing.T) {
+	src := &fakeStore{keys: map[string]bool{}, scanCh: make(chan Sigal)}
+	var backends []string
+	for i := 0; i < 3; i++ {
+		l := fakeBackend(t, src.reply)
+		defer l.Close()
+		backends = append(backends, l.Addr().String())
+	}
+	file := filepath.Join(t.TempDir(), "cfg.json")
+	extra := "" //more cfg keys
+	//an addr is quoted, a backend object is kept as it is
+	quote := func(v string) string {
+		if strings.HasPrefix(v, "{") {
+			return v
+		}
+		return `"` + v + `"`
+	}
+	writeCfg := func(addr0, addr1 string) {
+		cfg := `{"id":"1","ip":"127.0.0.1","port":"0","bucket_base":"1","buckets":[0,1],` + extra +
+			`"bucket_addr":{"0":` + quote(addr0) + `,"1":` + quote(addr1) + `}}`
+		if err := ioutil.WriteFile(file, []byte(cfg), 0600); err != nil {
+			t.Fatalf("write cfg err:%v", err)
+		}
+	}
+	buckets := func(srv *Server) map[int]string {
+		srv.bucketMux.RLock()
+		defer srv.bucketMux.RUnlock()
+		return srv.router.(*BucketRouter).bucketAddrMap
+	}
+
+	srv := NewServer()
+	if err := srv.Reload(); err != ErrNoCfgFile {
+		t.Errorf("reload before start err:%v", err)
+	}
+	writeCfg(backends[0], backends[1])
+	cfg, err := util.ParseConfigFile(file)
+	if err != nil {
+		t.Fatalf("parse cfg err:%v", err)
+	}
+	conf, err := srv.CheckConfig(cfg)
+	if err == nil {
+		err = srv.applyConfig(cfg, conf)
+	}
+	if err != nil {
+		t.Fatalf("apply config err:%v", err)
+	}
+	defer srv.connPool.Close()
+	defer srv.blockPool.Close()
+
+	writeCfg(backends[0], backends[2])
+	if err = srv.Reload(); err != nil || buckets(srv)[1] != backends[2] {
+		t.Fatalf("reload err:%v buckets:%v", err, buckets(srv))
+	}
+	if _, ok := srv.connPool.GetUintPool(backends[2]); !ok {
+		t.Errorf("no pool of the added backend")
+	}
+
+	//a pool is only drained once its backend is gone
+	srv.drainPool(backends[0])
+	srv.drainPool(backends[1])
+	if _, ok := srv.connPool.GetUintPool(backends[0]); !ok {
+		t.Errorf("pool of a backend in use drained")
+	}
+	if _, ok := srv.connPool.GetUintPool(backends[1]); ok {
+		t.Errorf("pool of a removed backend kept")
+	}
+
+	//no cfg is applied while a migration runs, a finished one outlives the file
+	m, err := srv.MigrateBucket(0, backends[1])
+	if err != nil {
+		t.Fatalf("migrate err:%v", err)
+	}
+	if err = srv.Reload(); err != ErrMigrationRuns {
+		t.Errorf("reload while migrating err:%v", err)
+	}
+	//nor are the settings of the running pools changed
+	extra = `"breaker_error_rate":"50",`
+	writeCfg(`{"addr":"`+backends[0]+`","user":"u","password":"p","tls":true}`, backends[2])
+	if err = srv.Reload(); err != ErrMigrationRuns {
+		t.Errorf("reload with settings while migrating err:%v", err)
+	}
+	if srv.connPool.Credential(backends[0]) != nil || srv.connPool.TLSConfig(backends[0]) != nil || srv.connPool.Breaker(backends[0]) != nil {
+		t.Errorf("settings of a running pool changed by a refused reload")
+	}
+	close(src.scanCh)
+	for i := 0; i < 200 && m.State() == MigrateRunning; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	extra = ""
+	writeCfg(backends[0], backends[2])
+	if err = srv.Reload(); err != nil || buckets(srv)[0] != backends[1] || buckets(srv)[1] != backends[2] {
+		t.Errorf("reload after migration err:%v buckets:%v", err, buckets(srv))
+	}
+
+	//a backend which can't be reached fails the reload before anything changes
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err:%v", err)
+	}
+	dead.Close()
+	writeCfg(`{"addr":"`+backends[1]+`","user":"u","password":"p"}`, dead.Addr().String())
+	if err = srv.Reload(); err == nil || buckets(srv)[1] != backends[2] {
+		t.Errorf("reload with a dead backend err:%v buckets:%v", err, buckets(srv))
+	}
+	if srv.connPool.Credential(backends[1]) != nil {
+		t.Errorf("credential of a running pool changed by a failed reload")
+	}
+	if _, ok := srv.connPool.GetUintPool(dead.Addr().String()); ok {
+		t.Errorf("pool of a dead backend kept")
+	}
+}
+
+// Starts srv on a free port of 127.0.0.1, returns its addr.
+func startProxy(t *testing.T, srv *Server) string {
+	srv.port = "0"
+	go srv.ListenAndServe()
+	for i := 0; i < 100; i++ {
+		srv.connMux.Lock()
+		l := srv.listener
+		srv.connMux.Unlock()
+		if l != nil {
+			return "127.0.0.1:" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("proxy not listening")
+	return ""
+}
+
+func TestShutdown(t *testing.T) {
+	gotCh, releaseCh := make(chan Sigal, 2), make(chan Sigal)
+	defer close(releaseCh)
+	l := fakeBackend(t, func(args []string) []byte {
+		if args[1] == "slow" {
+			gotCh <- Sigal{}
+			<-releaseCh
+		}
+		return PackBulk([]byte("v"))
+	})
+	defer l.Close()
+	addr := l.Addr().String()
+	newProxy := func() (*Server, net.Conn) {
+		srv := NewServer()
+		srv.policy = &CmdPolicy{}
+		srv.router = &BucketRouter{bucketBase: 1, buckets: []int{0}, bucketAddrMap: map[int]string{0: addr}}
+		if err := InitConnPool([]string{addr}, srv.connPool); err != nil {
+			t.Fatalf("init pool err:%v", err)
+		}
+		c, err := net.Dial("tcp", startProxy(t, srv))
+		if err != nil {
+			t.Fatalf("dial proxy err:%v", err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write(PackCmd("GET", "slow"))
+		<-gotCh
+		return srv, c
+	}
+
+	//the request in flight is answered before Shutdown returns
+	srv, c := newProxy()
+	defer c.Close()
+	doneCh := make(chan error, 1)
+	go func() { doneCh <- srv.Shutdown(context.Background()) }()
+	select {
+	case err := <-doneCh:
+		t.Fatalf("shutdown returned with a request in flight, err:%v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	releaseCh <- Sigal{}
+	if reply, err := ReadRaw(bufio.NewReader(c), nil); err != nil || string(reply) != "$1\r\nv\r\n" {
+		t.Errorf("in flight reply:%q err:%v", reply, err)
+	}
+	if err := <-doneCh; err != nil {
+		t.Errorf("shutdown err:%v", err)
+	}
+
+	//past the deadline of ctx the conns are closed
+	srv, c = newProxy()
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Errorf("shutdown err:%v after:%v", err, time.Since(start))
+	}
+	if _, err := ReadRaw(bufio.NewReader(c), nil); err == nil {
+		t.Errorf("conn not closed")
+	}
+}
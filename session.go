@@ -0,0 +1,222 @@
+package minproxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+const (
+	ProxyName    = "minproxy"
+	ProxyVersion = "1.0.0"
+)
+
+// Session is the state of one client conn, a task carries the session it
+// was read from.
+type Session struct {
+	Id    int64
+	Proto int
+
+	conn    net.Conn
+	wMux    sync.Mutex //replies and pushed messages are written concurrently
+	pending int        //replies owed to the client, guarded by wMux
+	pushes  [][]byte   //messages pushed while replies were owed, guarded by wMux
+	pubsub  *PubSub    //nil until the client subscribes
+	tx      Tx
+	user    string //user AUTH or HELLO logged in as
+	authed  bool
+
+	ctx    context.Context //canceled once the client is gone
+	cancel context.CancelFunc
+}
+
+// Counts a request read whose reply is owed, messages pushed from now on wait
+// for its reply: a message never overtakes the confirmation of SUBSCRIBE.
+func (sess *Session) queue() {
+	sess.wMux.Lock()
+	sess.pending++
+	sess.wMux.Unlock()
+}
+
+// Writes the reply of the oldest request owed one, then the messages held
+// once no reply is owed. A nil buf only drops the request.
+func (sess *Session) reply(buf []byte) (err error) {
+	sess.wMux.Lock()
+	defer sess.wMux.Unlock()
+
+	if len(buf) > 0 {
+		_, err = sess.conn.Write(buf)
+	}
+	if sess.pending--; sess.pending > 0 || len(sess.pushes) == 0 {
+		return
+	}
+	if err == nil {
+		_, err = sess.conn.Write(Append(sess.pushes))
+	}
+	sess.pushes = nil
+
+	return
+}
+
+// Writes a pushed message, held until the replies owed are written.
+func (sess *Session) push(buf []byte) (err error) {
+	sess.wMux.Lock()
+	defer sess.wMux.Unlock()
+
+	if sess.pending > 0 {
+		sess.pushes = append(sess.pushes, buf)
+		return
+	}
+	_, err = sess.conn.Write(buf)
+
+	return
+}
+
+// Returns the ctx canceled once the client is gone, one never done if the
+// session has none.
+func (sess *Session) context() context.Context {
+	if sess.ctx == nil {
+		return context.Background()
+	}
+
+	return sess.ctx
+}
+
+func (sess *Session) pubSub() *PubSub {
+	if sess.pubsub == nil {
+		sess.pubsub = newPubSub(sess)
+	}
+
+	return sess.pubsub
+}
+
+func (sess *Session) subscribed() bool {
+	if sess.pubsub == nil {
+		return false
+	}
+	sess.pubsub.mux.Lock()
+	defer sess.pubsub.mux.Unlock()
+
+	return sess.pubsub.count() > 0
+}
+
+func (sess *Session) Close() {
+	if sess.pubsub != nil {
+		sess.pubsub.Close()
+	}
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+// A client which hasn't authenticated yet must do so with AUTH.
+func (s *Server) handleHello(t *Task) {
+	args, err := GetVals(t.Raw[1:])
+	if err != nil {
+		t.PackErrorReply(err.Error())
+		return
+	}
+
+	proto := t.sess.Proto
+	if len(args) > 1 {
+		if proto, err = strconv.Atoi(string(args[1])); err != nil || (proto != Resp2 && proto != Resp3) {
+			t.PackErrorReply("NOPROTO unsupported protocol version")
+			return
+		}
+	}
+	user, authed := "", false
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == "auth" && i+2 < len(args):
+			if !s.clientAuth().Check(string(args[i+1]), string(args[i+2])) {
+				t.PackErrorReply(ErrWrongPass.Error())
+				return
+			}
+			user, authed = string(args[i+1]), true
+			i += 2
+		case opt == "setname" && i+1 < len(args):
+			i++
+		default:
+			t.PackErrorReply("ERR Syntax error in HELLO option '" + opt + "'")
+			return
+		}
+	}
+
+	if !authed && !t.sess.authed && s.clientAuth().Required() {
+		t.PackErrorReply(ErrHelloNoAuth.Error())
+		return
+	}
+	if authed {
+		t.sess.user, t.sess.authed = user, true
+	}
+
+	t.sess.Proto, t.Proto = proto, proto
+	info := &Resp{Type: '%', Elems: []*Resp{
+		bulkResp("server"), bulkResp(ProxyName),
+		bulkResp("version"), bulkResp(ProxyVersion),
+		bulkResp("proto"), {Type: ':', Val: []byte(strconv.Itoa(proto))},
+		bulkResp("id"), {Type: ':', Val: []byte(strconv.FormatInt(t.sess.Id, 10))},
+		bulkResp("mode"), bulkResp("proxy"),
+		bulkResp("role"), bulkResp("master"),
+		bulkResp("modules"), {Type: '*'},
+	}}
+	t.PackLocalReply(info.Encode(proto))
+}
+
+// PING [message]
+// A subscribed RESP2 client gets ["pong", message].
+func (s *Server) handlePing(t *Task) {
+	if len(t.Raw) > 3 {
+		t.PackErrorReply("ERR wrong number of arguments for 'ping' command")
+		return
+	}
+	msg := PackBulk([]byte{})
+	if len(t.Raw) == 3 {
+		msg = t.Raw[2]
+	}
+	switch {
+	case t.Proto == Resp2 && t.sess.subscribed():
+		t.PackLocalReply(PackArray([][]byte{PackBulk([]byte("pong")), msg}))
+	case len(t.Raw) == 2:
+		t.PackLocalReply(PackStatus("PONG"))
+	default:
+		t.PackLocalReply(msg)
+	}
+}
+
+// ECHO message
+func (s *Server) handleEcho(t *Task) {
+	t.PackLocalReply(t.Raw[2])
+}
+
+func bulkResp(s string) *Resp {
+	return &Resp{Type: '$', Val: []byte(s)}
+}
+
+// Switches a backend conn to proto with HELLO before it is used for a client
+// speaking proto. A backend without HELLO keeps speaking RESP2 and its replies
+// are converted instead. The reply of HELLO is awaited for the time left to
+// ctx, whatever deadline the pooled conn kept.
+func negotiate(ctx context.Context, c *util.Conn, proto int) error {
+	if c.Proto == proto || c.NoHello {
+		return nil
+	}
+	c.SetReadDeadline(time.Now().Add(timeLeft(ctx)))
+	if err := c.Write(PackCmd("HELLO", strconv.Itoa(proto))); err != nil {
+		return err
+	}
+	raw, err := ReadRaw(c.R, nil)
+	if err != nil {
+		return err
+	}
+	if raw[0] == '-' {
+		c.NoHello = true
+		return nil
+	}
+	c.Proto = proto
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package minproxy
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+const RequestTimeout = 10000 //ms
+
+var (
+	ErrReqTimeout     = errors.New("request timeout err")
+	ErrReqCanceled    = errors.New("request canceled err")
+	ErrBadCmdTimeouts = errors.New("bad command timeouts err")
+)
+
+// Timeouts bound every request from getting its conns to reading its reply:
+//"request_timeout":"10000" is the budget of a command in ms,
+//"command_timeouts":{"keys":"30000"} overrides it for the commands named.
+// A blocking command may block for its own timeout on top of the budget, for
+// ever if it blocks for ever, until its client is gone.
+type Timeouts struct {
+	request time.Duration
+	cmds    map[string]time.Duration //lowercase name -> budget
+}
+
+// Values are ms given as strings or as JSON numbers, a request_timeout of -1
+// keeps the default.
+func NewTimeouts(cfg *util.Config) (t *Timeouts, err error) {
+	t = &Timeouts{request: RequestTimeout * time.Millisecond, cmds: make(map[string]time.Duration)}
+	if v := cfg.GetInterface("request_timeout"); v != nil {
+		if n, ok := msOf(v); !ok || n == 0 || n < -1 {
+			return nil, ErrBadConfig
+		} else if n > 0 {
+			t.request = time.Duration(n) * time.Millisecond
+		}
+	}
+	cmds, ok := cfg.GetInterface("command_timeouts").(map[string]interface{})
+	if !ok && cfg.GetInterface("command_timeouts") != nil {
+		return nil, ErrBadCmdTimeouts
+	}
+	for name, v := range cmds {
+		n, ok := msOf(v)
+		if _, known := commands[strings.ToLower(name)]; !ok || n <= 0 || !known {
+			return nil, ErrBadCmdTimeouts
+		}
+		t.cmds[strings.ToLower(name)] = time.Duration(n) * time.Millisecond
+	}
+
+	return
+}
+
+// Returns the ms of a cfg value, "500" or 500.
+func msOf(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case string:
+		n, err := strconv.Atoi(v)
+		return n, err == nil
+	case float64:
+		return int(v), v == float64(int(v))
+	}
+
+	return 0, false
+}
+
+// Returns the budget of the task, the default one while there is no cfg.
+func (t *Timeouts) of(task *Task) time.Duration {
+	if t != nil && task.cmd != nil {
+		if d, ok := t.cmds[task.cmd.Name]; ok {
+			return d
+		}
+	}
+
+	return t.budget()
+}
+
+// Returns the budget of a request, also bounding what the proxy asks on its
+// own behalf such as the sentinels.
+func (t *Timeouts) budget() time.Duration {
+	if t == nil {
+		return RequestTimeout * time.Millisecond
+	}
+
+	return t.request
+}
+
+// Returns the ctx bounding the task. A blocking command is bounded by the
+// timeout it blocks for too and canceled once its client is gone, any other
+// is still answered while the client's queue drains.
+func (s *Server) requestContext(t *Task) (context.Context, context.CancelFunc) {
+	s.bucketMux.RLock()
+	budget := s.timeouts.of(t)
+	s.bucketMux.RUnlock()
+
+	if t.cmd == nil || !t.cmd.Is(CmdBlocking) {
+		return context.WithTimeout(context.Background(), budget)
+	}
+	d, ok := t.blockTimeout()
+	switch {
+	case !ok:
+		return context.WithTimeout(context.Background(), budget)
+	case d == 0:
+		return context.WithCancel(t.sess.context())
+	}
+
+	return context.WithTimeout(t.sess.context(), d+budget)
+}
+
+// Returns the ctx of the task, one never done if it has none.
+func (t *Task) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+
+	return t.ctx
+}
+
+// Releases the ctx of the task once it is answered.
+func (t *Task) done() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// Returns the time left until the deadline of ctx, the default budget if it
+// has none.
+func timeLeft(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+
+	return RequestTimeout * time.Millisecond
+}
+
+// Returns the err a request whose ctx is done fails with, err while it
+// isn't done. A conn deadline may pass before the ctx notices, so a deadline
+// passed is a timeout too.
+func ctxErr(ctx context.Context, err error) error {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return ErrReqTimeout
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrReqTimeout
+	case context.Canceled:
+		return ErrReqCanceled
+	}
+
+	return err
+}
@@ -0,0 +1,95 @@
+package minproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+var ErrBadTLSConfig = errors.New("bad tls config err")
+
+// Builds the TLS config of the client listener, nil when cfg has no
+// certificate:
+//"tls_cert_file" and "tls_key_file" are the certificate clients are served,
+//"tls_ca_cert_file" with "tls_auth_clients":true requires clients to present
+// a certificate signed by that CA.
+// The files are read again on every reload, so a renewed certificate is
+// served to the clients connecting after it.
+func NewServerTLS(cfg *util.Config) (conf *tls.Config, err error) {
+	certFile, keyFile := cfg.GetString("tls_cert_file"), cfg.GetString("tls_key_file")
+	if certFile == "" && keyFile == "" {
+		if cfg.GetBool("tls_auth_clients") {
+			return nil, ErrBadTLSConfig
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conf = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.GetBool("tls_auth_clients") {
+		if conf.ClientCAs, err = loadCAs(cfg.GetString("tls_ca_cert_file")); err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return
+}
+
+// Builds the TLS config the backends with "tls":true are dialed with:
+//"backend_tls_ca_cert_file" verifies them instead of the system CAs,
+//"backend_tls_cert_file" and "backend_tls_key_file" are presented to them,
+//"backend_tls_server_name" is verified instead of the host of their addr.
+func NewBackendTLS(cfg *util.Config) (conf *tls.Config, err error) {
+	conf = &tls.Config{ServerName: cfg.GetString("backend_tls_server_name"), MinVersion: tls.VersionTLS12}
+	if file := cfg.GetString("backend_tls_ca_cert_file"); file != "" {
+		if conf.RootCAs, err = loadCAs(file); err != nil {
+			return nil, err
+		}
+	}
+	certFile, keyFile := cfg.GetString("backend_tls_cert_file"), cfg.GetString("backend_tls_key_file")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return
+}
+
+func loadCAs(file string) (*x509.CertPool, error) {
+	if file == "" {
+		return nil, ErrBadTLSConfig
+	}
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrBadTLSConfig
+	}
+
+	return pool, nil
+}
+
+func (s *Server) tlsConf() *tls.Config {
+	s.bucketMux.RLock()
+	defer s.bucketMux.RUnlock()
+
+	return s.tls
+}
+
+// Hands every handshake the TLS config of the running cfg, so a reload swaps
+// the certificate without reopening the listener.
+func (s *Server) clientTLS(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return s.tlsConf(), nil
+}
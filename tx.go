@@ -0,0 +1,211 @@
+package minproxy
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/zimulala/minproxy/util"
+)
+
+var (
+	ErrExecAbort   = errors.New("EXECABORT Transaction discarded because of previous errors.")
+	ErrTxNoSupport = errors.New("ERR command not supported in a transaction by proxy")
+)
+
+// Commands changing the transaction state.
+var txCmds = map[string]bool{"multi": true, "exec": true, "discard": true, "watch": true, "unwatch": true}
+
+// Keyless commands queued on whatever conn the transaction pins.
+var connLocalCmds = map[string]bool{"ping": true, "echo": true}
+
+// Tx is the transaction state of a client conn. WATCH or the first command
+// with a key after MULTI pins a pooled conn of the backend the keys live on,
+// every later command must have its keys in the same bucket, so a migration
+// never splits the transaction. EXEC, DISCARD or UNWATCH put the conn back,
+// a failed conn aborts the transaction. PING and ECHO queued before a conn is
+// pinned are sent after MULTI, or answered by the proxy if none is pinned.
+type Tx struct {
+	conn    *util.Conn
+	addr    string
+	bucket  int      //bucket of the keys, -1 with a router without buckets
+	multi   bool     //MULTI was run
+	started bool     //MULTI was sent on conn
+	aborted bool     //a command failed to queue, EXEC discards
+	queued  [][]byte //PING and ECHO queued before a conn was pinned
+	replies [][]byte //of queued, EXEC replies them if no conn gets pinned
+}
+
+func (tx *Tx) reset() {
+	*tx = Tx{}
+}
+
+func (s *Server) handleTx(t *Task) {
+	tx := &t.sess.tx
+	switch name := strings.ToLower(string(t.Cmd)); {
+	case name == "multi":
+		if tx.multi {
+			t.PackErrorReply("ERR MULTI calls can not be nested")
+			return
+		}
+		tx.multi = true
+		t.PackLocalReply(PackStatus("OK"))
+	case name == "watch":
+		if tx.multi {
+			t.PackErrorReply("ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		if s.pinTx(t) {
+			s.sendTx(t, Append(t.Raw), 0, true)
+		}
+	case name == "unwatch" && !tx.multi:
+		if tx.conn == nil {
+			t.PackLocalReply(PackStatus("OK"))
+			return
+		}
+		s.sendTx(t, Append(t.Raw), 0, false)
+	case name == "exec" || name == "discard":
+		if !tx.multi {
+			t.PackErrorReply("ERR " + strings.ToUpper(name) + " without MULTI")
+			return
+		}
+		s.endTx(t, name == "exec")
+	default: //queued
+		local := t.cmd != nil && connLocalCmds[t.cmd.Name]
+		if local && tx.conn == nil {
+			if localCmds[t.cmd.Name](s, t); t.IsErrTask() {
+				tx.aborted = true
+				return
+			}
+			tx.queued, tx.replies = append(tx.queued, Append(t.Raw)), append(tx.replies, *t.Resp)
+			t.PackLocalReply(PackStatus("QUEUED"))
+			return
+		}
+		if !local && !s.pinTx(t) {
+			tx.aborted = true
+			return
+		}
+		if tx.started {
+			s.sendTx(t, Append(t.Raw), 0, true)
+			return
+		}
+		//the client got +QUEUED of the commands queued before already
+		data, skip := Append(append(append([][]byte{PackCmd("MULTI")}, tx.queued...), Append(t.Raw))), 1+len(tx.queued)
+		tx.started, tx.queued, tx.replies = true, nil, nil
+		s.sendTx(t, data, skip, true)
+	}
+}
+
+// Sends EXEC or DISCARD on the pinned conn and puts the conn back once the
+// reply is read. A transaction aborted while queueing is discarded.
+func (s *Server) endTx(t *Task, exec bool) {
+	tx := &t.sess.tx
+	defer tx.reset()
+
+	switch {
+	case tx.conn == nil && exec && tx.aborted:
+		t.PackErrorReply(ErrExecAbort.Error())
+	case tx.conn == nil && exec:
+		t.PackLocalReply(PackArray(tx.replies))
+	case tx.conn == nil:
+		t.PackLocalReply(PackStatus("OK"))
+	case !tx.started && exec && tx.aborted:
+		t.txAbort = true
+		s.sendTx(t, PackCmd("UNWATCH"), 0, false)
+	case !tx.started && exec: //only WATCH was sent
+		s.sendTx(t, append(PackCmd("MULTI"), PackCmd("EXEC")...), 1, false)
+	case !tx.started:
+		s.sendTx(t, PackCmd("UNWATCH"), 0, false)
+	case exec && tx.aborted:
+		t.txAbort = true
+		s.sendTx(t, PackCmd("DISCARD"), 0, false)
+	default:
+		s.sendTx(t, Append(t.Raw), 0, false)
+	}
+}
+
+// Pins a conn of the backend the keys of the task live on. The keys must all
+// live in one bucket, the one already pinned if there is one, and the bucket
+// must not have moved since.
+func (s *Server) pinTx(t *Task) bool {
+	tx := &t.sess.tx
+	if len(t.OutInfos) == 0 || (t.cmd != nil && t.cmd.Is(CmdBroadcast)) {
+		t.PackErrorReply(ErrTxNoSupport.Error())
+		return false
+	}
+	addrs, err := s.GetAddrs(t)
+	if err != nil {
+		t.PackErrorReply(err.Error())
+		return false
+	}
+	addr, bucket := addrs[0], s.bucketOf(t.OutInfos[0].key)
+	if tx.conn != nil {
+		addr, bucket = tx.addr, tx.bucket
+	}
+	for i, info := range t.OutInfos {
+		if addrs[i] != addr || s.bucketOf(info.key) != bucket {
+			t.PackErrorReply(ErrCrossSlot.Error())
+			return false
+		}
+	}
+	if tx.conn != nil {
+		return true
+	}
+
+	ctx := t.context()
+	if tx.conn, err = s.connPool.GetConnContext(ctx, addr); err == util.ErrBackendDown || err == util.ErrCtxDone {
+		t.PackErrorReply(ctxErr(ctx, ErrBackendDown).Error())
+		return false
+	} else if err == util.ErrPoolFull {
+		t.PackErrorReply(ctxErr(ctx, ErrGetConn).Error())
+		return false
+	} else if err != nil {
+		s.connPool.PutConn(addr, nil)
+		t.PackErrorReply(ctxErr(ctx, ErrGetConn).Error())
+		return false
+	}
+	tx.addr, tx.bucket = addr, bucket
+
+	return true
+}
+
+// Returns the bucket the tag is routed by, -1 if the router has no buckets.
+func (s *Server) bucketOf(tag []byte) int {
+	s.bucketMux.RLock()
+	defer s.bucketMux.RUnlock()
+
+	if r, ok := s.router.(*BucketRouter); ok {
+		return r.Bucket(tag)
+	}
+
+	return -1
+}
+
+// Sends data on the pinned conn, the first skip replies are dropped. A conn
+// which stays pinned isn't put back by ReleaseConns, otherwise the pin ends.
+// A conn failing, on this write or on the read of an earlier reply, is closed
+// and put back: the pin ends and EXEC discards the transaction.
+func (s *Server) sendTx(t *Task, data []byte, skip int, pinned bool) {
+	tx := &t.sess.tx
+	t.inTx = true
+	p := &UnitPkg{conn: tx.conn, data: data, skip: skip, pinned: pinned}
+	t.OutInfos = []*UnitPkg{p}
+	err := p.send(t.context(), s.connPool, tx.addr, t.Proto)
+	switch {
+	case err != nil && pinned:
+		p.pinned = false //the closed conn is put back by ReleaseConns
+		multi := tx.multi
+		tx.reset()
+		tx.multi, tx.aborted = multi, multi
+	case !pinned:
+		tx.reset()
+	}
+}
+
+// Puts back the conn a client left pinned when it went away.
+func (s *Server) releaseTx(sess *Session) {
+	if sess.tx.conn != nil {
+		sess.tx.conn.Close()
+		s.connPool.PutConn(sess.tx.addr, nil)
+		sess.tx.reset()
+	}
+}
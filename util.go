@@ -2,9 +2,10 @@ package minproxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"log"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,45 +22,254 @@ const (
 	WriteToConnErr   = 1
 	ConnOk           = 2
 	ConnOkStr        = ""
+	CfgDrainDelay    = ConnReadDeadline * 2
+	BlockConnSize    = 100 //conns per backend blocking commands may hold at once
+
+	BreakerMinRequests = 20
+	BreakerWindow      = 10000 //ms
+	BreakerOpen        = 5000  //ms
+	BreakerProbes      = 5
 )
 
 var (
-	ErrBadConfig    = errors.New("bad config err")
-	ErrBadBucketKey = errors.New("bad bucket key err")
-	ErrGetConn      = errors.New("get conn err")
-	ErrWriteToConn  = errors.New("write to conn err")
+	ErrBadConfig      = errors.New("bad config err")
+	ErrBadBucketKey   = errors.New("bad bucket key err")
+	ErrGetConn        = errors.New("get conn err")
+	ErrWriteToConn    = errors.New("write to conn err")
+	ErrBackendDown    = errors.New("backend down err")
+	ErrBreakerOpen    = errors.New("backend circuit open err")
+	ErrNoCfgFile      = errors.New("no cfg file err")
+	ErrCfgNeedRestart = errors.New("id, ip, port and tls on/off can't be changed without restart err")
+	ErrMigrationRuns  = errors.New("a bucket migration runs, the cfg can't be applied err")
 )
 
 type Sigal struct{}
 
-func (s *Server) CheckConfig(cfg *util.Config) error {
-	s.id = cfg.GetInt("id")
-	s.ip = cfg.GetString("ip")
-	s.port = cfg.GetString("port")
-	s.bucketBase = cfg.GetInt("bucket_base")
-	buckets := cfg.GetArray("buckets")
-	bucketAddrMap := cfg.GetInterface("bucket_addr").(map[string]interface{})
+// Conf is what a cfg resolves to, CheckConfig builds a fresh one on every
+// (re)load so the running one is untouched until it is swapped.
+type Conf struct {
+	id       int
+	ip       string
+	port     string
+	router   Router
+	policy   *CmdPolicy
+	auth     *Auth
+	health   *util.HealthCheck //nil when backends aren't checked
+	breaker  *util.BreakerConf //nil when backends have no breaker
+	timeouts *Timeouts
+
+	backends   map[string]backend //key: addr
+	backendTLS *tls.Config        //of the backends with "tls":true
+	tls        *tls.Config        //of the client listener, nil for plaintext
+	replicas   *Replicas
+	masters    map[string]string //master name -> addr of the "master_name" entries
+}
+
+// Validates cfg and resolves it into a Conf, the running server is left as
+// it is until applyConfig swaps the Conf in. Once the server runs, id, ip and
+// port must stay the same.
+func (s *Server) CheckConfig(cfg *util.Config) (*Conf, error) {
+	return s.checkConfig(cfg, nil)
+}
 
-	for _, b := range buckets {
-		s.buckets = append(s.buckets, int(b.(float64)))
+// CheckConfig, the masters known are taken as they are instead of asking the
+// sentinels for them.
+func (s *Server) checkConfig(cfg *util.Config, known map[string]string) (conf *Conf, err error) {
+	conf = &Conf{id: cfg.GetInt("id"), ip: cfg.GetString("ip"), port: cfg.GetString("port")}
+	if conf.id == -1 || conf.ip == "" || conf.port == "" {
+		return nil, ErrBadConfig
+	}
+	if s.port != "" && (conf.id != s.id || conf.ip != s.ip || conf.port != s.port) {
+		return nil, ErrCfgNeedRestart
+	}
+
+	if conf.timeouts, err = NewTimeouts(cfg); err != nil {
+		return nil, err
+	}
+	//the backends are read from a cfg holding the masters the sentinels know
+	backendCfg, masters, err := resolveMasters(cfg, known, conf.timeouts.budget())
+	if err != nil {
+		return nil, err
+	}
+	conf.masters = masters
+	if conf.router, err = NewRouter(backendCfg); err != nil {
+		return nil, err
+	}
+	if conf.policy, err = NewCmdPolicy(cfg); err != nil {
+		return nil, err
+	}
+	if conf.auth, err = NewAuth(cfg); err != nil {
+		return nil, err
+	}
+	if conf.health, err = NewHealthCheck(cfg); err != nil {
+		return nil, err
+	}
+	if conf.breaker, err = NewBreakerConf(cfg); err != nil {
+		return nil, err
+	}
+	if conf.backends, err = backendsOf(backendCfg); err != nil {
+		return nil, err
+	}
+	if conf.replicas, err = NewReplicas(cfg, conf.backends); err != nil {
+		return nil, err
+	}
+	if conf.backendTLS, err = NewBackendTLS(cfg); err != nil {
+		return nil, err
 	}
-	for b, addr := range bucketAddrMap {
-		bInt, err := strconv.Atoi(b)
+	if conf.tls, err = NewServerTLS(cfg); err != nil {
+		return nil, err
+	}
+	if s.port != "" && (conf.tls == nil) != (s.tlsConf() == nil) {
+		return nil, ErrCfgNeedRestart
+	}
+
+	return
+}
+
+// Creates the pools of the new backends of conf and swaps its router in, the
+// running router and the settings of the running pools are kept if anything
+// fails or a migration runs. Pools of backends which are gone are drained:
+// nothing waits for their requests, the pool is removed after the fixed
+// CfgDrainDelay and its idle conns closed, a conn still held then is closed
+// when it is put back.
+func (s *Server) applyConfig(cfg *util.Config, conf *Conf) (err error) {
+	s.bucketMux.RLock()
+	runs := s.migrationRuns()
+	s.bucketMux.RUnlock()
+	if runs {
+		//swapping the router would end the migration with keys already moved
+		return ErrMigrationRuns
+	}
+
+	addrs := allAddrs(conf.router, conf.replicas)
+	var created []string //removed again if applying fails
+	defer func() {
 		if err != nil {
-			return err
+			for _, addr := range created {
+				s.connPool.RemoveUnitPool(addr)
+				s.blockPool.RemoveUnitPool(addr)
+			}
+		}
+	}()
+	for _, addr := range addrs {
+		if _, ok := s.connPool.GetUintPool(addr); ok {
+			continue
+		}
+		s.setBackend(addr, conf)
+		created = append(created, addr)
+		if err = InitConnPool([]string{addr}, s.connPool); err != nil {
+			return
+		}
+	}
+	if err = InitBlockPool(addrs, s.blockPool); err != nil {
+		return
+	}
+
+	s.bucketMux.Lock()
+	if s.migrationRuns() { //started meanwhile
+		s.bucketMux.Unlock()
+		return ErrMigrationRuns
+	}
+	for _, addr := range addrs {
+		s.setBackend(addr, conf)
+		for _, connP := range []*util.ConnPool{s.connPool, s.blockPool} {
+			if p, ok := connP.GetUintPool(addr); ok && conf.health != nil {
+				p.StartHealthCheck(*conf.health)
+			} else if ok {
+				p.StopHealthCheck()
+			}
 		}
-		s.bucketAddrMap[bInt] = addr.(string)
+	}
+	s.connPool.SetBreaker(conf.breaker)
+	old, oldReplicas := s.router, s.replicas
+	s.router, s.replicas, s.policy, s.auth, s.tls, s.cfg = conf.router, conf.replicas, conf.policy, conf.auth, conf.tls, cfg
+	s.timeouts, s.masters = conf.timeouts, conf.masters
+	s.bucketMux.Unlock()
+	if len(sentinelsOf(cfg)) > 0 {
+		s.sentinelOnce.Do(func() { go s.watchSentinels() })
+	}
+	if old == nil {
+		return
 	}
 
-	if s.id == -1 || s.ip == "" || s.port == "" {
-		return ErrBadConfig
+	removed := make(map[string]bool)
+	for _, addr := range allAddrs(old, oldReplicas) {
+		removed[addr] = true
+	}
+	for _, addr := range addrs {
+		delete(removed, addr)
+	}
+	for addr := range removed {
+		addr := addr
+		time.AfterFunc(CfgDrainDelay*time.Second, func() { s.drainPool(addr) })
 	}
 
-	return nil
+	return
+}
+
+// Sets the credential and the TLS config conf dials the backend addr with.
+func (s *Server) setBackend(addr string, conf *Conf) {
+	b, tlsConf := conf.backends[addr], (*tls.Config)(nil)
+	if b.tls {
+		tlsConf = conf.backendTLS
+	}
+	for _, p := range []*util.ConnPool{s.connPool, s.blockPool} {
+		p.SetCredential(addr, b.cred)
+		p.SetTLSConfig(addr, tlsConf)
+	}
 }
 
-func InitConnPool(addrMap map[int]string, connP *util.ConnPool) (err error) {
-	for _, addr := range addrMap {
+// Removes the pool of addr unless a reload in between brought it back.
+func (s *Server) drainPool(addr string) {
+	s.bucketMux.RLock()
+	for _, a := range allAddrs(s.router, s.replicas) {
+		if a == addr {
+			s.bucketMux.RUnlock()
+			return
+		}
+	}
+	s.bucketMux.RUnlock()
+
+	if err := s.connPool.RemoveUnitPool(addr); err != nil {
+		log.Println("drain pool, addr:", addr, " err:", err)
+	}
+	s.blockPool.RemoveUnitPool(addr)
+}
+
+// Re-reads the cfg file the server was started with and applies it.
+func (s *Server) Reload() error {
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+
+	s.bucketMux.RLock()
+	filename := ""
+	if s.cfg != nil { //nil until Start applied the first cfg
+		filename = s.cfg.Filename()
+	}
+	s.bucketMux.RUnlock()
+	if filename == "" {
+		return ErrNoCfgFile
+	}
+
+	cfg, err := util.ParseConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	cfg = s.withMigrations(cfg)
+	conf, err := s.CheckConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	return s.applyConfig(cfg, conf)
+}
+
+// Creates the unit pools of addrs, addrs which already have one are skipped.
+func InitConnPool(addrs []string, connP *util.ConnPool) (err error) {
+	for _, addr := range addrs {
+		if _, ok := connP.GetUintPool(addr); ok {
+			continue
+		}
 		if _, err = connP.NewUnitPool(ConnSize, addr, ConnTimeout, ConnRetrys); err != nil {
 			break
 		}
@@ -68,43 +278,126 @@ func InitConnPool(addrMap map[int]string, connP *util.ConnPool) (err error) {
 	return
 }
 
+// Builds the health check of the backends from cfg:
+//"health_check_interval":"1000" PINGs every backend every 1000ms, "0" turns
+// the check off,
+//"health_check_down_after":"3" failures in a row mark a backend down,
+//"health_check_up_after":"2" successes in a row bring it back.
+func NewHealthCheck(cfg *util.Config) (*util.HealthCheck, error) {
+	interval := cfg.GetInt("health_check_interval")
+	downAfter, upAfter := cfg.GetInt("health_check_down_after"), cfg.GetInt("health_check_up_after")
+	if interval < -1 || downAfter == 0 || downAfter < -1 || upAfter == 0 || upAfter < -1 {
+		return nil, ErrBadConfig
+	}
+	if interval == 0 {
+		return nil, nil
+	}
+
+	//unset values are -1, which HealthCheck takes as its defaults
+	return &util.HealthCheck{Interval: time.Duration(interval) * time.Millisecond, DownAfter: downAfter, UpAfter: upAfter}, nil
+}
+
+// Builds the circuit breaker of the backends from cfg, nil unless
+// "breaker_error_rate" is set:
+//"breaker_error_rate":"50" opens it once 50% of the requests failed,
+//"breaker_min_requests":"20" are needed in a window first,
+//"breaker_window":"10000" is the window in ms,
+//"breaker_slow":"1000" counts a request slower than 1000ms as failed,
+//"breaker_open":"5000" keeps it open for 5000ms before probing,
+//"breaker_probes":"5" requests must succeed while half-open to close it.
+// Blocking commands, which are slow on purpose, are never counted.
+func NewBreakerConf(cfg *util.Config) (*util.BreakerConf, error) {
+	rate := cfg.GetInt("breaker_error_rate")
+	if rate == -1 {
+		return nil, nil
+	}
+	conf := &util.BreakerConf{ErrorRate: float64(rate) / 100, MinRequests: BreakerMinRequests,
+		Window: BreakerWindow * time.Millisecond, OpenFor: BreakerOpen * time.Millisecond, Probes: BreakerProbes}
+	if n := cfg.GetInt("breaker_min_requests"); n != -1 {
+		conf.MinRequests = n
+	}
+	if n := cfg.GetInt("breaker_window"); n != -1 {
+		conf.Window = time.Duration(n) * time.Millisecond
+	}
+	if n := cfg.GetInt("breaker_slow"); n != -1 {
+		conf.SlowLatency = time.Duration(n) * time.Millisecond
+	}
+	if n := cfg.GetInt("breaker_open"); n != -1 {
+		conf.OpenFor = time.Duration(n) * time.Millisecond
+	}
+	if n := cfg.GetInt("breaker_probes"); n != -1 {
+		conf.Probes = n
+	}
+	if rate <= 0 || rate > 100 || conf.MinRequests <= 0 || conf.Window <= 0 || conf.OpenFor <= 0 || conf.Probes <= 0 {
+		return nil, ErrBadConfig
+	}
+
+	return conf, nil
+}
+
+// Creates the bounded unit pools blocking commands use, so a blocked conn
+// never holds one of the pools of other commands.
+func InitBlockPool(addrs []string, connP *util.ConnPool) (err error) {
+	for _, addr := range addrs {
+		if _, ok := connP.GetUintPool(addr); ok {
+			continue
+		}
+		if _, err = connP.NewBoundedUnitPool(BlockConnSize, addr, ConnTimeout, ConnRetrys); err != nil {
+			break
+		}
+	}
+
+	return
+}
+
 func GenerateId() int64 {
 	return time.Now().UnixNano()
 }
 
+// Returns the backends of the UnitPkgs. A key of a migrating bucket is double
+// routed by a plain read, any other command moves it to the target first.
 func (s *Server) GetAddrs(pkg *Task) (addrs []string, err error) {
-	weights := make([]int64, len(pkg.OutInfos))
 	addrs = make([]string, len(pkg.OutInfos))
+	moving := make(map[*UnitPkg]*Migration)
+	double := pkg.doubleRoutable()
 
+	s.bucketMux.RLock()
 	for i, info := range pkg.OutInfos {
-		for _, k := range info.key {
-			weights[i] += int64(k)
+		if addrs[i], err = s.router.GetAddr(info.key); err != nil {
+			s.bucketMux.RUnlock()
+			return nil, err
+		}
+		if m := s.migrating(info.key); m != nil && double {
+			m.doubleRoute(info)
+			addrs[i], info.moved = m.From, true
+		} else if m != nil {
+			moving[info] = m
+			addrs[i], info.moved = m.To, true
 		}
 	}
+	s.bucketMux.RUnlock()
 
-	s.bucketMux.RLock()
-	defer s.bucketMux.RUnlock()
-	for i, w := range weights {
-		bucket := int(w % int64(len(s.buckets)/s.bucketBase))
-		addr, ok := s.bucketAddrMap[bucket]
-		if !ok {
-			return nil, ErrBadBucketKey
+	for info, m := range moving {
+		if err = m.moveKey(pkg.context(), s, info.rawKey); err != nil {
+			return nil, err
 		}
-		addrs[i] = addr
 	}
 
 	return
 }
 
+// Returns the pool the conn of the UnitPkg comes from.
+func (s *Server) poolOf(p *UnitPkg) *util.ConnPool {
+	if p.block {
+		return s.blockPool
+	}
+
+	return s.connPool
+}
+
 func (s *Server) GetConns(addrs []string, task *Task) (err error) {
 	if len(task.OutInfos) == 1 {
-		if task.OutInfos[0].conn, err = s.connPool.GetConn(addrs[0]); err == nil {
-			err = task.OutInfos[0].conn.Write(task.OutInfos[0].data)
-		}
-		if err != nil {
-			task.OutInfos[0].connAddr = addrs[0]
-		}
-		return
+		return s.sendTo(task.context(), task.OutInfos[0], addrs[0], task.Proto)
 	}
 
 	isErr := uint32(ConnOk)
@@ -112,19 +405,14 @@ func (s *Server) GetConns(addrs []string, task *Task) (err error) {
 
 	for i, info := range task.OutInfos {
 		wg.Add(1)
-		go func() {
-			if info.conn, err = s.connPool.GetConn(addrs[i]); err != nil {
-				info.connAddr = addrs[i]
+		go func(addr string, info *UnitPkg) {
+			if err := s.sendTo(task.context(), info, addr, task.Proto); err == ErrGetConn {
 				atomic.StoreUint32(&isErr, GetConnErr)
-				wg.Done()
-				return
-			}
-			if err = info.conn.Write(info.data); err != nil {
-				info.connAddr = addrs[i]
+			} else if err != nil {
 				atomic.StoreUint32(&isErr, WriteToConnErr)
 			}
 			wg.Done()
-		}()
+		}(addrs[i], info)
 	}
 	wg.Wait()
 
@@ -137,13 +425,83 @@ func (s *Server) GetConns(addrs []string, task *Task) (err error) {
 	return
 }
 
+// Sends the UnitPkg unless the breaker of addr is open, the outcome is
+// recorded once the reply is read or the send failed.
+func (s *Server) sendTo(ctx context.Context, p *UnitPkg, addr string, proto int) (err error) {
+	connP := s.poolOf(p)
+	if p.block {
+		return p.send(ctx, connP, addr, proto)
+	}
+	b := connP.Breaker(addr)
+	if !b.Allow() {
+		p.err = ErrBreakerOpen
+		return p.err
+	}
+	p.breaker, p.sentAt = b, time.Now()
+	if err = p.send(ctx, connP, addr, proto); err != nil {
+		p.recordOutcome()
+	}
+
+	return
+}
+
+// Records on the breaker whether the backend failed the UnitPkg and how long
+// it took, once.
+func (p *UnitPkg) recordOutcome() {
+	if p.breaker != nil {
+		p.breaker.Done(p.err != nil, time.Since(p.sentAt))
+		p.breaker = nil
+	}
+}
+
+// Gets a conn of addr unless one is pinned, switches it to the client's proto
+// and writes the request, giving up once ctx is done. On error connAddr keeps
+// addr, so only the pool slot is put back.
+func (p *UnitPkg) send(ctx context.Context, connP *util.ConnPool, addr string, proto int) (err error) {
+	deadline, _ := ctx.Deadline()
+	if p.conn == nil { //a pinned conn keeps its proto, its replies are converted
+		if p.conn, err = connP.GetConnContext(ctx, addr); err == util.ErrBackendDown || err == util.ErrCtxDone {
+			p.err = ctxErr(ctx, ErrBackendDown) //no slot was taken, none is put back
+			return p.err
+		} else if err == util.ErrPoolFull {
+			p.err = ctxErr(ctx, ErrGetConn) //no slot was taken either
+			return p.err
+		} else if err != nil {
+			p.connAddr, p.err = addr, ctxErr(ctx, ErrGetConn)
+			return p.err
+		}
+		err = negotiate(ctx, p.conn, proto)
+	}
+	if err == nil {
+		p.conn.SetWriteDeadline(deadline)
+		err = p.conn.Write(p.data)
+		p.conn.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		p.conn.Close()
+		p.conn, p.connAddr, p.err = nil, addr, ctxErr(ctx, ErrWriteToConn)
+		return p.err
+	}
+
+	return nil
+}
+
 func (s *Server) ReleaseConns(pkg *Task) {
 	for _, info := range pkg.OutInfos {
+		if info.replica != "" {
+			s.addOutstanding(info.replica, -1)
+		}
+		info.recordOutcome() //of one whose reply was never read
+		if info.pinned {
+			continue
+		}
 		if info.connAddr == ConnOkStr {
-			s.connPool.PutConn(info.conn.Addr(), info.conn)
+			if info.conn != nil {
+				s.poolOf(info).PutConn(info.conn.Addr(), info.conn)
+			}
 			continue
 		}
-		s.connPool.PutConn(info.connAddr, nil)
+		s.poolOf(info).PutConn(info.connAddr, nil)
 	}
 }
 
@@ -159,3 +517,14 @@ func GetVal(s []byte) (val []byte, err error) {
 
 	return
 }
+
+func GetVals(raws [][]byte) (vals [][]byte, err error) {
+	vals = make([][]byte, len(raws))
+	for i, raw := range raws {
+		if vals[i], err = GetVal(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
@@ -0,0 +1,165 @@
+package util
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+var breakerStates = []string{"closed", "open", "half-open"}
+
+// BreakerConf is when the breaker of a unit pool opens and how it closes.
+// It opens once ErrorRate of the requests of the last Window failed, but
+// not before MinRequests were made. A request slower than SlowLatency counts
+// as failed unless SlowLatency is 0. After OpenFor it lets Probes requests
+// through, it closes once they all succeeded and opens again on a failure.
+type BreakerConf struct {
+	Window      time.Duration
+	MinRequests int
+	ErrorRate   float64
+	SlowLatency time.Duration
+	OpenFor     time.Duration
+	Probes      int
+}
+
+type Breaker struct {
+	mu       sync.Mutex
+	addr     string
+	conf     BreakerConf
+	state    int
+	start    time.Time //of the window
+	requests int
+	failures int
+	openedAt time.Time
+	probes   int //probes let through
+	probeOks int
+}
+
+func newBreaker(addr string, conf BreakerConf) *Breaker {
+	if conf.Probes <= 0 {
+		conf.Probes = 1
+	}
+
+	return &Breaker{addr: addr, conf: conf, start: time.Now()}
+}
+
+// Returns whether a request may be made, one let through while half-open is
+// a probe. A nil breaker lets everything through.
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.conf.OpenFor {
+		b.state, b.probes, b.probeOks = BreakerHalfOpen, 0, 0
+	}
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probes >= b.conf.Probes {
+			return false
+		}
+		b.probes++
+	}
+
+	return true
+}
+
+// Records the outcome of a request Allow let through.
+func (b *Breaker) Done(failed bool, latency time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed = failed || (b.conf.SlowLatency > 0 && latency > b.conf.SlowLatency)
+	switch b.state {
+	case BreakerClosed:
+		if time.Since(b.start) > b.conf.Window {
+			b.start, b.requests, b.failures = time.Now(), 0, 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.conf.MinRequests && float64(b.failures) >= b.conf.ErrorRate*float64(b.requests) {
+			b.open()
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.open()
+			return
+		}
+		if b.probeOks++; b.probeOks >= b.conf.Probes {
+			b.state, b.start, b.requests, b.failures = BreakerClosed, time.Now(), 0, 0
+			log.Println("breaker, addr:", b.addr, " is closed")
+		}
+	}
+}
+
+// The caller holds mu.
+func (b *Breaker) open() {
+	b.state, b.openedAt = BreakerOpen, time.Now()
+	log.Println("breaker, addr:", b.addr, " is open, requests:", b.requests, " failures:", b.failures)
+}
+
+func (b *Breaker) setConf(conf BreakerConf) {
+	if conf.Probes <= 0 {
+		conf.Probes = 1
+	}
+	b.mu.Lock()
+	b.conf = conf
+	b.mu.Unlock()
+}
+
+// Returns "closed", "open" or "half-open", "off" for a nil breaker.
+func (b *Breaker) State() string {
+	if b == nil {
+		return "off"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return breakerStates[b.state]
+}
+
+// Gives every unit pool a breaker of conf, the ones which have one keep
+// their state. A nil conf removes them.
+func (connp *ConnPool) SetBreaker(conf *BreakerConf) {
+	connp.rwMu.Lock()
+	defer connp.rwMu.Unlock()
+
+	connp.breakerConf = conf
+	for addr, p := range connp.unitPools {
+		switch {
+		case conf == nil:
+			p.breaker = nil
+		case p.breaker == nil:
+			p.breaker = newBreaker(addr, *conf)
+		default:
+			p.breaker.setConf(*conf)
+		}
+	}
+}
+
+// Returns the breaker of the unit pool of addr, nil if it has none.
+func (connp *ConnPool) Breaker(addr string) *Breaker {
+	connp.rwMu.RLock()
+	defer connp.rwMu.RUnlock()
+
+	if p, ok := connp.unitPools[addr]; ok {
+		return p.breaker
+	}
+
+	return nil
+}
@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"sort"
 	"strconv"
 )
 
 type Config struct {
-	data map[string]interface{}
+	filename string
+	data     map[string]interface{}
 }
 
 func newConfig() *Config {
@@ -19,8 +21,7 @@ func newConfig() *Config {
 
 // Loads config information from a JSON file
 func LoadConfigFile(filename string) *Config {
-	result := newConfig()
-	err := result.parse(filename)
+	result, err := ParseConfigFile(filename)
 	if err != nil {
 		log.Fatalf("error loading config file %s: %s", filename, err)
 	}
@@ -28,6 +29,17 @@ func LoadConfigFile(filename string) *Config {
 	return result
 }
 
+// Loads config information from a JSON file, returns the error instead of exiting
+func ParseConfigFile(filename string) (*Config, error) {
+	result := newConfig()
+	if err := result.parse(filename); err != nil {
+		return nil, err
+	}
+	result.filename = filename
+
+	return result, nil
+}
+
 // Loads config information from a JSON string
 func LoadConfigString(s string) *Config {
 	result := newConfig()
@@ -39,6 +51,38 @@ func LoadConfigString(s string) *Config {
 	return result
 }
 
+// Returns the file the config was loaded from, "" for a config string
+func (c *Config) Filename() string {
+	return c.filename
+}
+
+// Returns a copy of the config, nested values are shared
+func (c *Config) Clone() *Config {
+	result := newConfig()
+	result.filename = c.filename
+	for k, v := range c.data {
+		result.data[k] = v
+	}
+
+	return result
+}
+
+// Returns the sorted config variable keys
+func (c *Config) Keys() []string {
+	keys := make([]string, 0, len(c.data))
+	for k := range c.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Sets the config variable key, val is a decoded JSON value
+func (c *Config) Set(key string, val interface{}) {
+	c.data[key] = val
+}
+
 func (c *Config) parse(fileName string) error {
 	jsonFileBytes, err := ioutil.ReadFile(fileName)
 	if err == nil {
@@ -2,25 +2,122 @@ package util
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
-const DefaultMinReadBufferSize = 1024
+const (
+	DefaultMinReadBufferSize = 1024
+	UnixPrefix               = "unix:"
+)
 
 type Conn struct {
 	addr string
-	c    *net.TCPConn
+	c    net.Conn //a *net.TCPConn or *net.UnixConn, or a *tls.Conn over one
 	R    *bufio.Reader
+
+	Proto   int  //RESP version the conn speaks, 2 until HELLO switched it
+	NoHello bool //the backend doesn't know HELLO, the conn stays RESP2
+}
+
+// Returns the network and address addr is dialed or listened on, "unix:/path"
+// is the unix socket at /path and anything else an address of network.
+func SplitAddr(network, addr string) (string, string) {
+	if strings.HasPrefix(addr, UnixPrefix) {
+		return "unix", addr[len(UnixPrefix):]
+	}
+
+	return network, addr
 }
 
 func NewCon(network, addr string, timeout time.Duration) (*Conn, error) {
-	c, err := net.DialTimeout(network, addr, timeout)
+	return DialContext(context.Background(), network, addr, timeout, nil)
+}
+
+// Dials addr and does the TLS handshake of tlsConf within timeout, the server
+// name is the host of addr unless tlsConf sets one, which a unix socket needs.
+func NewTLSCon(network, addr string, timeout time.Duration, tlsConf *tls.Config) (*Conn, error) {
+	return DialContext(context.Background(), network, addr, timeout, tlsConf)
+}
+
+// Dials addr within timeout, over TLS unless tlsConf is nil. It gives up as
+// soon as ctx is done.
+func DialContext(ctx context.Context, network, addr string, timeout time.Duration, tlsConf *tls.Config) (*Conn, error) {
+	network, address := SplitAddr(network, addr)
+	d := &net.Dialer{Timeout: timeout}
+	var c net.Conn
+	var err error
+	if tlsConf != nil {
+		c, err = (&tls.Dialer{NetDialer: d, Config: tlsConf}).DialContext(ctx, network, address)
+	} else {
+		c, err = d.DialContext(ctx, network, address)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &Conn{addr: addr, c: c.(*net.TCPConn), R: bufio.NewReaderSize(c, DefaultMinReadBufferSize)}, nil
+	return newConn(addr, c), nil
+}
+
+func newConn(addr string, c net.Conn) *Conn {
+	return &Conn{addr: addr, c: c, R: bufio.NewReaderSize(c, DefaultMinReadBufferSize), Proto: 2}
+}
+
+// Returns the TCP conn under c, false if there is none, e.g. for a unix
+// socket.
+func TCPConn(c net.Conn) (*net.TCPConn, bool) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	tcp, ok := c.(*net.TCPConn)
+
+	return tcp, ok
+}
+
+// Sends AUTH [user] password and waits up to timeout for its reply, a refused
+// AUTH is ErrAuth.
+func (c *Conn) Auth(cred *Credential, timeout time.Duration) (err error) {
+	args := []string{"AUTH", cred.Password}
+	if cred.User != "" {
+		args = []string{"AUTH", cred.User, cred.Password}
+	}
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	line, err := c.roundTrip(buf, timeout)
+	if err == nil && line[0] != '+' {
+		err = ErrAuth
+	}
+
+	return
+}
+
+// Sends PING and waits up to timeout for its reply, an error reply such as
+// LOADING is ErrPing.
+func (c *Conn) Ping(timeout time.Duration) (err error) {
+	line, err := c.roundTrip([]byte("*1\r\n$4\r\nPING\r\n"), timeout)
+	if err == nil && line[0] == '-' {
+		err = ErrPing
+	}
+
+	return
+}
+
+// Writes a command whose reply is a single line and reads that line.
+func (c *Conn) roundTrip(buf []byte, timeout time.Duration) (line []byte, err error) {
+	if err = c.Write(buf); err != nil {
+		return
+	}
+
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	return c.R.ReadBytes('\n')
 }
 
 func (c *Conn) Write(buf []byte) (err error) {
@@ -37,12 +134,24 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 	return c.c.SetReadDeadline(t)
 }
 
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.c.SetWriteDeadline(t)
+}
+
 func (c *Conn) SetKeepAlive(b bool) error {
-	return c.c.SetKeepAlive(b)
+	if tcp, ok := TCPConn(c.c); ok {
+		return tcp.SetKeepAlive(b)
+	}
+
+	return nil
 }
 
 func (c *Conn) SetNoDelay(b bool) error {
-	return c.c.SetNoDelay(b)
+	if tcp, ok := TCPConn(c.c); ok {
+		return tcp.SetNoDelay(b)
+	}
+
+	return nil
 }
 
 func (c Conn) Addr() string {
@@ -1,7 +1,10 @@
 package util
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 )
@@ -18,11 +21,32 @@ var (
 	ErrPoolFull         = errors.New("PoolFullError")
 	ErrAddrEmpty        = errors.New("AddrEmptyError")
 	ErrNotExistUnitPool = errors.New("NotExistUnitPoolErr")
+	ErrAuth             = errors.New("AuthError")
+	ErrCtxDone          = errors.New("CtxDoneError")
 )
 
+// Credential is sent with AUTH on every new conn of a backend, User is empty
+// for the default user.
+type Credential struct {
+	User     string
+	Password string
+}
+
 type ConnPool struct {
 	rwMu      sync.RWMutex
 	unitPools map[string]*UnitConnPool
+	creds     map[string]*Credential //key: addr
+	tlsConfs  map[string]*tls.Config //key: addr, backends dialed over TLS
+
+	breakerConf *BreakerConf //of the breakers of new unit pools, nil for none
+}
+
+type UnitPoolStat struct {
+	Addr    string
+	Size    int
+	Free    int //slots no request holds, an idle conn or room to dial one
+	Down    bool
+	Breaker string
 }
 
 type UnitConnPool struct {
@@ -31,13 +55,100 @@ type UnitConnPool struct {
 	trys    int
 	addr    string
 	pool    chan *Conn
+	bounded bool      //Get fails with ErrPoolFull instead of dialing past size
+	connp   *ConnPool //holds the credential of addr
+
+	hcMu   sync.Mutex
+	hc     HealthCheck
+	stopCh chan struct{} //nil while no health check runs
+	down   int32         //set by the health check, read atomically
+
+	breaker *Breaker //guarded by the rwMu of the ConnPool, nil for none
 }
 
 func NewConnPool() *ConnPool {
-	return &ConnPool{unitPools: make(map[string]*UnitConnPool)}
+	return &ConnPool{unitPools: make(map[string]*UnitConnPool), creds: make(map[string]*Credential),
+		tlsConfs: make(map[string]*tls.Config)}
+}
+
+// Sets the credential new conns of addr authenticate with, a nil cred drops
+// it. Conns already dialed keep the one they were dialed with.
+func (connp *ConnPool) SetCredential(addr string, cred *Credential) {
+	connp.rwMu.Lock()
+	defer connp.rwMu.Unlock()
+
+	if cred == nil {
+		delete(connp.creds, addr)
+		return
+	}
+	connp.creds[addr] = cred
+}
+
+func (connp *ConnPool) Credential(addr string) *Credential {
+	connp.rwMu.RLock()
+	defer connp.rwMu.RUnlock()
+
+	return connp.creds[addr]
+}
+
+// Sets the TLS config new conns of addr are dialed with, a nil conf dials
+// them in plaintext.
+func (connp *ConnPool) SetTLSConfig(addr string, conf *tls.Config) {
+	connp.rwMu.Lock()
+	defer connp.rwMu.Unlock()
+
+	if conf == nil {
+		delete(connp.tlsConfs, addr)
+		return
+	}
+	connp.tlsConfs[addr] = conf
+}
+
+func (connp *ConnPool) TLSConfig(addr string) *tls.Config {
+	connp.rwMu.RLock()
+	defer connp.rwMu.RUnlock()
+
+	return connp.tlsConfs[addr]
+}
+
+// Dials a conn of addr over TLS if it has a TLS config and authenticates it if
+// it has a credential. The unit pools dial with it, conns which are never
+// pooled may too.
+func (connp *ConnPool) Dial(addr string, timeout time.Duration) (c *Conn, err error) {
+	return connp.DialContext(context.Background(), addr, timeout)
+}
+
+// Dial, given up once ctx is done. AUTH waits no longer than ctx allows.
+func (connp *ConnPool) DialContext(ctx context.Context, addr string, timeout time.Duration) (c *Conn, err error) {
+	if c, err = DialContext(ctx, ConnType, addr, timeout, connp.TLSConfig(addr)); err != nil {
+		return
+	}
+	cred := connp.Credential(addr)
+	if cred == nil {
+		return
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if err = c.Auth(cred, timeout); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return
 }
 
 func (connp *ConnPool) NewUnitPool(size int, addr string, timeout, trys int) (p *UnitConnPool, err error) {
+	return connp.newUnitPool(size, addr, timeout, trys, false)
+}
+
+// Creates a unit pool which never holds more than size conns, Get fails with
+// ErrPoolFull while all of them are in use.
+func (connp *ConnPool) NewBoundedUnitPool(size int, addr string, timeout, trys int) (p *UnitConnPool, err error) {
+	return connp.newUnitPool(size, addr, timeout, trys, true)
+}
+
+func (connp *ConnPool) newUnitPool(size int, addr string, timeout, trys int, bounded bool) (p *UnitConnPool, err error) {
 	if size < 0 {
 		size = DefaultSize
 	}
@@ -48,10 +159,15 @@ func (connp *ConnPool) NewUnitPool(size int, addr string, timeout, trys int) (p
 		return nil, ErrAddrEmpty
 	}
 
-	p = &UnitConnPool{addr: addr, size: size, timeout: timeout, trys: trys, pool: make(chan *Conn, size)}
+	p = &UnitConnPool{addr: addr, size: size, timeout: timeout, trys: trys, pool: make(chan *Conn, size), bounded: bounded, connp: connp}
 	for i := 0; i < size; i++ {
 		p.pool <- nil
 	}
+	connp.rwMu.RLock()
+	if connp.breakerConf != nil {
+		p.breaker = newBreaker(addr, *connp.breakerConf)
+	}
+	connp.rwMu.RUnlock()
 	if err = p.Ping(); err != nil {
 		return
 	}
@@ -70,17 +186,35 @@ func (p *UnitConnPool) Ping() (err error) {
 	return
 }
 
+// Takes an idle conn or dials one. A backend the health check marked down
+// fails with ErrBackendDown at once, no slot of the pool is taken then.
 func (p *UnitConnPool) Get() (c *Conn, err error) {
+	return p.GetContext(context.Background())
+}
+
+// Get, given up once ctx is done. A ctx done already fails with ErrCtxDone and
+// takes no slot, a dial given up keeps the slot it took like any failed one.
+func (p *UnitConnPool) GetContext(ctx context.Context) (c *Conn, err error) {
+	if p.Down() {
+		return nil, ErrBackendDown
+	}
+	if ctx.Err() != nil {
+		return nil, ErrCtxDone
+	}
 	select {
 	case c = <-p.pool:
 		if c != nil {
 			return
 		}
 	default:
+		if p.bounded {
+			return nil, ErrPoolFull
+		}
 	}
 
 	for i := 0; i < p.trys; i++ {
-		if c, err = NewCon(ConnType, p.addr, time.Duration(p.timeout)*time.Second); err == nil {
+		c, err = p.connp.DialContext(ctx, p.addr, time.Duration(p.timeout)*time.Second)
+		if err == nil || err == ErrAuth || ctx.Err() != nil {
 			break
 		}
 	}
@@ -98,7 +232,7 @@ func (p *UnitConnPool) Put(conn *Conn) (err error) {
 	select {
 	case p.pool <- conn:
 	default:
-		if conn.c != nil {
+		if conn != nil && conn.c != nil {
 			conn.Close()
 		}
 	}
@@ -115,10 +249,21 @@ func (connp *ConnPool) GetConn(addr string) (c *Conn, err error) {
 	return p.Get()
 }
 
+// GetConn, given up once ctx is done. See UnitConnPool.GetContext for which
+// failures leave a slot to put back.
+func (connp *ConnPool) GetConnContext(ctx context.Context, addr string) (c *Conn, err error) {
+	p, ok := connp.GetUintPool(addr)
+	if !ok {
+		return nil, ErrNotExistUnitPool
+	}
+
+	return p.GetContext(ctx)
+}
+
 func (connp *ConnPool) PutConn(addr string, conn *Conn) (err error) {
 	p, ok := connp.GetUintPool(addr)
 	if !ok {
-		if conn.c != nil {
+		if conn != nil && conn.c != nil {
 			conn.Close()
 		}
 		return
@@ -133,6 +278,49 @@ func (connp *ConnPool) SetUintPool(addr string, p *UnitConnPool) {
 	connp.rwMu.Unlock()
 }
 
+// Removes the unit pool of addr, idle conns are closed at once and conns in
+// use are closed when they are put back.
+func (connp *ConnPool) RemoveUnitPool(addr string) error {
+	connp.rwMu.Lock()
+	p, ok := connp.unitPools[addr]
+	delete(connp.unitPools, addr)
+	connp.rwMu.Unlock()
+	if !ok {
+		return ErrNotExistUnitPool
+	}
+	p.StopHealthCheck()
+	p.Close()
+
+	return nil
+}
+
+// Removes all unit pools and closes their idle conns.
+func (connp *ConnPool) Close() {
+	connp.rwMu.Lock()
+	pools := connp.unitPools
+	connp.unitPools = make(map[string]*UnitConnPool)
+	connp.rwMu.Unlock()
+
+	for _, p := range pools {
+		p.StopHealthCheck()
+		p.Close()
+	}
+}
+
+// Closes the idle conns of the pool.
+func (p *UnitConnPool) Close() {
+	for {
+		select {
+		case c := <-p.pool:
+			if c != nil {
+				c.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
 func (connp *ConnPool) GetUintPool(addr string) (p *UnitConnPool, ok bool) {
 	connp.rwMu.RLock()
 	p, ok = connp.unitPools[addr]
@@ -140,3 +328,16 @@ func (connp *ConnPool) GetUintPool(addr string) (p *UnitConnPool, ok bool) {
 
 	return
 }
+
+// Returns the stats of all unit pools sorted by addr
+func (connp *ConnPool) Stats() []UnitPoolStat {
+	connp.rwMu.RLock()
+	stats := make([]UnitPoolStat, 0, len(connp.unitPools))
+	for addr, p := range connp.unitPools {
+		stats = append(stats, UnitPoolStat{Addr: addr, Size: p.size, Free: len(p.pool), Down: p.Down(), Breaker: p.breaker.State()})
+	}
+	connp.rwMu.RUnlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+
+	return stats
+}
@@ -1,9 +1,13 @@
 package util
 
 import (
+	"bufio"
+	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const (
@@ -83,3 +87,167 @@ func BenchmarkConnPool(b *testing.B) {
 
 	wg.Wait()
 }
+
+func TestBoundedConnPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen err:", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	addr := l.Addr().String()
+	p := NewConnPool()
+	if _, err = p.NewBoundedUnitPool(1, addr, 3, -1); err != nil {
+		t.Fatal("new pool err:", err)
+	}
+	defer p.Close()
+
+	c, err := p.GetConn(addr)
+	if err != nil {
+		t.Fatal("get conn err:", err)
+	}
+	if _, err = p.GetConn(addr); err != ErrPoolFull {
+		t.Fatal("get conn of full pool err:", err)
+	}
+	if st := p.Stats(); st[0].Free != 0 || st[0].Size != 1 {
+		t.Fatalf("full pool free:%d size:%d", st[0].Free, st[0].Size)
+	}
+	p.PutConn(addr, c)
+	if c, err = p.GetConn(addr); err != nil {
+		t.Fatal("get conn err:", err)
+	}
+	p.PutConn(addr, c)
+}
+
+func TestHealthCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen err:", err)
+	}
+	defer l.Close()
+	var failing int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					if line[0] == '*' || line[0] == '$' { //only the PING line is answered
+						continue
+					}
+					if atomic.LoadInt32(&failing) == 1 {
+						c.Write([]byte("-LOADING Redis is loading the dataset in memory\r\n"))
+						continue
+					}
+					c.Write([]byte("+PONG\r\n"))
+				}
+			}(c)
+		}
+	}()
+
+	addr := l.Addr().String()
+	connp := NewConnPool()
+	p, err := connp.NewUnitPool(1, addr, 1, 1)
+	if err != nil {
+		t.Fatal("new pool err:", err)
+	}
+	p.StartHealthCheck(HealthCheck{Interval: 10 * time.Millisecond, DownAfter: 2, UpAfter: 2})
+	defer connp.Close()
+	waitDown := func(down bool) {
+		for i := 0; i < 200 && connp.Down(addr) != down; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if connp.Down(addr) != down {
+			t.Fatal("backend down:", !down, " want:", down)
+		}
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	waitDown(true)
+	if _, err = connp.GetConn(addr); err != ErrBackendDown {
+		t.Error("get conn of a down backend err:", err)
+	}
+	if st := connp.Stats(); len(st) != 1 || !st[0].Down {
+		t.Error("stats:", st)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	waitDown(false)
+	c, err := connp.GetConn(addr)
+	if err != nil {
+		t.Fatal("get conn of a recovered backend err:", err)
+	}
+	connp.PutConn(addr, c)
+
+	//a check stopped while it pings leaves the backend up
+	atomic.StoreInt32(&failing, 1)
+	for i := 0; i < 50; i++ {
+		p.StartHealthCheck(HealthCheck{Interval: time.Millisecond, DownAfter: 1, UpAfter: 1})
+		time.Sleep(time.Duration(i%5) * time.Millisecond)
+		p.StopHealthCheck()
+		time.Sleep(2 * time.Millisecond)
+		if p.Down() {
+			t.Fatal("backend down after the check stopped, round:", i)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(Addr, BreakerConf{Window: time.Minute, MinRequests: 4, ErrorRate: 0.5,
+		SlowLatency: 100 * time.Millisecond, OpenFor: 20 * time.Millisecond, Probes: 2})
+
+	//fewer requests than MinRequests never open it
+	for i := 0; i < 3; i++ {
+		b.Allow()
+		b.Done(true, 0)
+	}
+	if b.State() != "closed" {
+		t.Fatal("state after 3 failures:", b.State())
+	}
+	b.Allow()
+	b.Done(false, time.Second) //slow
+	if b.State() != "open" || b.Allow() {
+		t.Fatal("state after 4 failures:", b.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() || !b.Allow() || b.Allow() {
+		t.Fatal("half-open doesn't let 2 probes through, state:", b.State())
+	}
+	b.Done(false, 0)
+	b.Done(true, 0)
+	if b.State() != "open" {
+		t.Fatal("state after a failed probe:", b.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	b.Allow()
+	b.Allow()
+	b.Done(false, 0)
+	b.Done(false, 0)
+	if b.State() != "closed" || !b.Allow() {
+		t.Fatal("state after the probes succeeded:", b.State())
+	}
+
+	var nilBreaker *Breaker
+	if !nilBreaker.Allow() || nilBreaker.State() != "off" {
+		t.Fatal("a nil breaker doesn't let requests through")
+	}
+}
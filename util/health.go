@@ -0,0 +1,149 @@
+package util
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultCheckInterval = time.Second
+	DefaultDownAfter     = 3
+	DefaultUpAfter       = 2
+)
+
+var (
+	ErrBackendDown = errors.New("BackendDownError")
+	ErrPing        = errors.New("PingError")
+)
+
+// HealthCheck is how often a unit pool PINGs its backend, how many failures
+// in a row mark it down and how many successes in a row bring it back.
+type HealthCheck struct {
+	Interval  time.Duration
+	DownAfter int
+	UpAfter   int
+}
+
+func (hc HealthCheck) withDefaults() HealthCheck {
+	if hc.Interval <= 0 {
+		hc.Interval = DefaultCheckInterval
+	}
+	if hc.DownAfter <= 0 {
+		hc.DownAfter = DefaultDownAfter
+	}
+	if hc.UpAfter <= 0 {
+		hc.UpAfter = DefaultUpAfter
+	}
+
+	return hc
+}
+
+// Starts PINGing the backend of the pool on a conn of its own, a check
+// already running just takes the new hc.
+func (p *UnitConnPool) StartHealthCheck(hc HealthCheck) {
+	p.hcMu.Lock()
+	defer p.hcMu.Unlock()
+
+	p.hc = hc.withDefaults()
+	if p.stopCh == nil {
+		p.stopCh = make(chan struct{})
+		go p.healthCheck(p.stopCh)
+	}
+}
+
+// Stops the check, the backend is taken as up again.
+func (p *UnitConnPool) StopHealthCheck() {
+	p.hcMu.Lock()
+	defer p.hcMu.Unlock()
+
+	if p.stopCh != nil {
+		close(p.stopCh)
+		p.stopCh = nil
+	}
+	atomic.StoreInt32(&p.down, 0)
+}
+
+func (p *UnitConnPool) healthConf() HealthCheck {
+	p.hcMu.Lock()
+	defer p.hcMu.Unlock()
+
+	return p.hc
+}
+
+// Returns whether the check marked the backend down, Get fails with
+// ErrBackendDown meanwhile.
+func (p *UnitConnPool) Down() bool {
+	return atomic.LoadInt32(&p.down) == 1
+}
+
+func (p *UnitConnPool) healthCheck(stopCh chan struct{}) {
+	var c *Conn
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+
+	timeout := time.Duration(p.timeout) * time.Second
+	fails, oks := 0, 0
+	for {
+		hc := p.healthConf()
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(hc.Interval):
+		}
+
+		var err error
+		if c == nil {
+			c, err = p.connp.Dial(p.addr, timeout)
+		}
+		if err == nil {
+			if err = c.Ping(timeout); err != nil {
+				c.Close()
+				c = nil
+			}
+		}
+		if err != nil {
+			fails, oks = fails+1, 0
+		} else {
+			fails, oks = 0, oks+1
+		}
+
+		switch {
+		case !p.Down() && fails >= hc.DownAfter:
+			if !p.setDown(stopCh, 1) {
+				return
+			}
+			log.Println("health check, addr:", p.addr, " is down, err:", err)
+		case p.Down() && oks >= hc.UpAfter:
+			if !p.setDown(stopCh, 0) {
+				return
+			}
+			log.Println("health check, addr:", p.addr, " is up")
+		}
+	}
+}
+
+// Stores the state the check of stopCh found unless the check was stopped
+// while it pinged, so a stopped check never marks the backend down again.
+func (p *UnitConnPool) setDown(stopCh chan struct{}, down int32) bool {
+	p.hcMu.Lock()
+	defer p.hcMu.Unlock()
+
+	if p.stopCh != stopCh {
+		return false
+	}
+	atomic.StoreInt32(&p.down, down)
+
+	return true
+}
+
+// Returns whether the health check of the unit pool of addr marked it down.
+func (connp *ConnPool) Down(addr string) bool {
+	p, ok := connp.GetUintPool(addr)
+
+	return ok && p.Down()
+}